@@ -0,0 +1,52 @@
+package fasthttpprometheus
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrMetricNameCollision is returned if metric name of route is taken by another route, see WithCollisionStrategy
+var ErrMetricNameCollision = errors.New("metric name collision")
+
+// ErrInvalidRouteLabel is returned if const label of route has invalid name or overrides label set by library,
+// see WithRouteConstLabels
+var ErrInvalidRouteLabel = errors.New("invalid route label")
+
+// ErrRouteRegistered is returned if route with the same http method and template is registered already
+var ErrRouteRegistered = errors.New("route is already registered")
+
+// ErrHelpConflict is returned if help text of route differs from help text of metric with the same name
+// registered before, see WithRouteHelp
+var ErrHelpConflict = errors.New("help text conflict")
+
+// RouteError is error of route registration, e.g. metric of the route collides with metric of another route
+type RouteError struct {
+	Method string
+	Path   string
+	Err    error
+}
+
+func (e *RouteError) Error() string {
+	return "can't register route " + e.Method + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *RouteError) Unwrap() error {
+	return e.Err
+}
+
+// RegistrationErrors contains errors of all routes which failed registration, see Validate
+type RegistrationErrors []error
+
+func (e RegistrationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap returns errors of routes, it's supported by errors.Is and errors.As since go 1.20
+func (e RegistrationErrors) Unwrap() []error {
+	return e
+}
@@ -0,0 +1,98 @@
+package fasthttpprometheus
+
+import (
+	"github.com/valyala/fasthttp"
+)
+
+// group registers routes with shared path prefix and route options,
+// options of route are applied after options of group
+type group struct {
+	handler *handler
+	prefix  string
+	opts    []RouteOption
+}
+
+// Group returns registrar of routes with path prefix, e.g. /api/v1.
+// Prefix must begin with "/" and must not end with "/"
+func (h *handler) Group(prefix string, opts ...RouteOption) *group {
+	validatePrefix(prefix)
+
+	return &group{
+		handler: h,
+		prefix:  prefix,
+		opts:    opts,
+	}
+}
+
+// Group returns nested group which inherits prefix and options of the group
+func (g *group) Group(prefix string, opts ...RouteOption) *group {
+	validatePrefix(prefix)
+
+	return &group{
+		handler: g.handler,
+		prefix:  g.prefix + prefix,
+		opts:    g.routeOptions(opts),
+	}
+}
+
+func (g *group) GET(path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	g.Handle(fasthttp.MethodGet, path, handle, opts...)
+}
+
+func (g *group) HEAD(path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	g.Handle(fasthttp.MethodHead, path, handle, opts...)
+}
+
+func (g *group) OPTIONS(path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	g.Handle(fasthttp.MethodOptions, path, handle, opts...)
+}
+
+func (g *group) POST(path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	g.Handle(fasthttp.MethodPost, path, handle, opts...)
+}
+
+func (g *group) PUT(path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	g.Handle(fasthttp.MethodPut, path, handle, opts...)
+}
+
+func (g *group) PATCH(path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	g.Handle(fasthttp.MethodPatch, path, handle, opts...)
+}
+
+func (g *group) DELETE(path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	g.Handle(fasthttp.MethodDelete, path, handle, opts...)
+}
+
+func (g *group) Handle(method, path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	g.handler.Handle(method, g.prefix+path, handle, g.routeOptions(opts)...)
+}
+
+// Register registers route with prefix of the group like handler.Register
+// and returns *RouteError if metrics of the route can't be registered
+func (g *group) Register(method, path string, handle fasthttp.RequestHandler, opts ...RouteOption) error {
+	return g.handler.Register(method, g.prefix+path, handle, g.routeOptions(opts)...)
+}
+
+// MustRegister registers route with prefix of the group like handler.MustRegister
+// and panics with *RouteError if metrics of the route can't be registered
+func (g *group) MustRegister(method, path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	g.handler.MustRegister(method, g.prefix+path, handle, g.routeOptions(opts)...)
+}
+
+func (g *group) ServeFiles(path string, rootPath string, opts ...RouteOption) {
+	g.handler.ServeFiles(g.prefix+path, rootPath, g.routeOptions(opts)...)
+}
+
+// routeOptions returns options of group followed by given options
+func (g *group) routeOptions(opts []RouteOption) []RouteOption {
+	routeOpts := make([]RouteOption, 0, len(g.opts)+len(opts))
+	routeOpts = append(routeOpts, g.opts...)
+
+	return append(routeOpts, opts...)
+}
+
+func validatePrefix(prefix string) {
+	if len(prefix) < 2 || prefix[0] != slashByte || prefix[len(prefix)-1] == slashByte {
+		panic("group prefix must begin with '/' and must not end with '/' in prefix '" + prefix + "'")
+	}
+}
@@ -0,0 +1,170 @@
+package fasthttpprometheus
+
+import (
+	"testing"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/suite"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+type groupSuite struct {
+	suite.Suite
+
+	handler *handler
+}
+
+func TestGroupSuite(t *testing.T) {
+	suite.Run(t, &groupSuite{})
+}
+
+func (s *groupSuite) SetupTest() {
+	s.handler = NewHandler(fasthttprouter.New(), "test_service", zap.NewNop(), WithRegisterer(prometheus.NewRegistry()))
+}
+
+func (s *groupSuite) TestGroupPrefix() {
+	api := s.handler.Group("/api/v1")
+	api.GET("/user/:id", func(ctx *fasthttp.RequestCtx) {})
+	api.POST("/user/:id", func(ctx *fasthttp.RequestCtx) {})
+	api.Group("/admin").DELETE("/user/:id", func(ctx *fasthttp.RequestCtx) {})
+
+	ctx := newRequestCtx("GET", "/api/v1/user/1")
+	s.handler.Handler(ctx)
+	s.Equal(fasthttp.StatusOK, ctx.Response.StatusCode())
+
+	leaf := s.handler.routes()["GET"].getLeaf("/api/v1/user/1")
+	s.Equal(
+		"Desc{fqName: \"test_service_api_v1_user_id_var_requests_total\", "+
+			"help: \"Total requests to routes named api_v1_user_id_var\", "+
+			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
+		leaf.metrics[metricTypeTotal].Desc().String(),
+	)
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	s.NotNil(s.handler.routes()["POST"].getLeaf("/api/v1/user/1"))
+	s.NotNil(s.handler.routes()["DELETE"].getLeaf("/api/v1/admin/user/1"))
+}
+
+func (s *groupSuite) TestGroupConstLabels() {
+	api := s.handler.Group("/api", WithRouteConstLabels(prometheus.Labels{"team": "core", "api": "public"}))
+	api.GET("/ping", func(ctx *fasthttp.RequestCtx) {}, WithRouteConstLabels(prometheus.Labels{"team": "platform"}))
+	api.Group("/v2", WithRouteConstLabels(prometheus.Labels{"version": "2"})).GET("/ping", func(ctx *fasthttp.RequestCtx) {})
+
+	leaf := s.handler.routes()["GET"].getLeaf("/api/ping")
+	s.Equal(
+		"Desc{fqName: \"test_service_api_ping_requests_total\", "+
+			"help: \"Total requests to routes named api_ping\", "+
+			"constLabels: {api=\"public\",http_method=\"GET\",team=\"platform\"}, variableLabels: []}",
+		leaf.metrics[metricTypeTotal].Desc().String(),
+	)
+	s.Equal(
+		"Desc{fqName: \"test_service_api_ping_requests_duration_seconds\", "+
+			"help: \"Duration of requests to routes named api_ping in seconds\", "+
+			"constLabels: {api=\"public\",http_method=\"GET\",team=\"platform\"}, variableLabels: []}",
+		leaf.histograms[metricTypeDuration].Desc().String(),
+	)
+
+	leaf = s.handler.routes()["GET"].getLeaf("/api/v2/ping")
+	s.Equal(
+		"Desc{fqName: \"test_service_api_v2_ping_requests_total\", "+
+			"help: \"Total requests to routes named api_v2_ping\", "+
+			"constLabels: {api=\"public\",http_method=\"GET\",team=\"core\",version=\"2\"}, variableLabels: []}",
+		leaf.metrics[metricTypeTotal].Desc().String(),
+	)
+}
+
+func (s *groupSuite) TestGroupFailureClassifier() {
+	isServerError := func(ctx *fasthttp.RequestCtx) bool {
+		return ctx.Response.StatusCode() >= fasthttp.StatusInternalServerError
+	}
+	api := s.handler.Group("/api", WithRouteFailureClassifier(isServerError))
+	api.GET("/user/:id", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+	})
+	api.GET("/article/:id", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+	}, WithRouteFailureClassifier(defaultFailureClassifier))
+
+	s.handler.Handler(newRequestCtx("GET", "/api/user/1"))
+	s.handler.Handler(newRequestCtx("GET", "/api/article/1"))
+
+	leaf := s.handler.routes()["GET"].getLeaf("/api/user/1")
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	s.Equal(float64(0), testutil.ToFloat64(leaf.metrics[metricTypeFailure]))
+
+	leaf = s.handler.routes()["GET"].getLeaf("/api/article/1")
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeFailure]))
+}
+
+func (s *groupSuite) TestGroupWithoutInstrumentation() {
+	internal := s.handler.Group("/internal", WithoutRouteInstrumentation())
+	internal.GET("/health", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	})
+
+	ctx := newRequestCtx("GET", "/internal/health")
+	s.handler.Handler(ctx)
+
+	s.Equal(fasthttp.StatusServiceUnavailable, ctx.Response.StatusCode())
+	leaf := s.handler.routes()["GET"].getLeaf("/internal/health")
+	s.True(leaf.disabled)
+	s.Nil(leaf.metrics)
+	s.Nil(leaf.histograms)
+	s.Equal(0, testutil.CollectAndCount(s.handler.unmatched))
+	s.Equal(float64(0), testutil.ToFloat64(s.handler.inFlight))
+}
+
+func (s *groupSuite) TestGroupServeFiles() {
+	dir := s.T().TempDir()
+	s.handler.Group("/assets").ServeFiles("/*filepath", dir)
+
+	s.handler.Handler(newRequestCtx("GET", "/assets/app.js"))
+
+	leaf := s.handler.routes()["GET"].getLeaf("/assets/app.js")
+	s.Equal(
+		"Desc{fqName: \"test_service_assets_filepath_all_requests_total\", "+
+			"help: \"Total requests to routes named assets_filepath_all\", "+
+			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
+		leaf.metrics[metricTypeTotal].Desc().String(),
+	)
+}
+
+func (s *groupSuite) TestGroupRegister() {
+	api := s.handler.Group("/api", WithRouteConstLabels(prometheus.Labels{"team": "core"}))
+	s.NoError(api.Register("GET", "/user-info", func(ctx *fasthttp.RequestCtx) {}))
+
+	err := api.Register("GET", "/user_info", func(ctx *fasthttp.RequestCtx) {})
+
+	var routeErr *RouteError
+	s.Require().ErrorAs(err, &routeErr)
+	s.Equal("/api/user_info", routeErr.Path)
+	s.ErrorIs(err, ErrMetricNameCollision)
+	handle, _ := s.handler.Lookup("GET", "/api/user_info", &fasthttp.RequestCtx{})
+	s.Nil(handle)
+	s.PanicsWithError(
+		"can't register route POST /api/user_info: metric name collision: "+
+			"test_service_api_user_info_requests_total is taken by route /api/user-info",
+		func() {
+			api.MustRegister("POST", "/user_info", func(ctx *fasthttp.RequestCtx) {})
+		},
+	)
+
+	leaf := s.handler.routes()["GET"].getLeaf("/api/user-info")
+	s.Equal(
+		"Desc{fqName: \"test_service_api_user_info_requests_total\", "+
+			"help: \"Total requests to routes named api_user_info\", "+
+			"constLabels: {http_method=\"GET\",team=\"core\"}, variableLabels: []}",
+		leaf.metrics[metricTypeTotal].Desc().String(),
+	)
+}
+
+func (s *groupSuite) TestGroupInvalidPrefix() {
+	for _, prefix := range []string{"", "/", "api", "/api/"} {
+		s.Panics(func() {
+			s.handler.Group(prefix)
+		}, prefix)
+	}
+}
@@ -0,0 +1,121 @@
+package fasthttpprometheus
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// skipKey marks requests which must not be instrumented, e.g. requests to metrics endpoint
+type skipKey struct{}
+
+// MetricsOption configures metrics endpoint registered by ServeMetrics
+type MetricsOption func(o *metricsOptions)
+
+type metricsOptions struct {
+	gatherer    prometheus.Gatherer
+	compression bool
+	openMetrics bool
+}
+
+// WithGatherer sets gatherer of exposed metrics.
+// By default registerer of handler is used if it is prometheus.Gatherer (e.g. *prometheus.Registry),
+// otherwise prometheus.DefaultGatherer
+func WithGatherer(gatherer prometheus.Gatherer) MetricsOption {
+	return func(o *metricsOptions) {
+		o.gatherer = gatherer
+	}
+}
+
+// WithoutCompression disables gzip compression of response even if client accepts it
+func WithoutCompression() MetricsOption {
+	return func(o *metricsOptions) {
+		o.compression = false
+	}
+}
+
+// WithoutOpenMetrics disables OpenMetrics format negotiation, only prometheus text and protobuf formats are served
+func WithoutOpenMetrics() MetricsOption {
+	return func(o *metricsOptions) {
+		o.openMetrics = false
+	}
+}
+
+// ServeMetrics registers metrics exposition handler on GET path.
+// Requests to the path are not instrumented
+func (h *handler) ServeMetrics(path string, opts ...MetricsOption) {
+	h.router.Handle(fasthttp.MethodGet, path, h.MetricsHandler(opts...))
+}
+
+// MetricsHandler returns metrics exposition handler, e.g. to register it in router not owned by handler.
+// Requests to the handler are not instrumented
+func (h *handler) MetricsHandler(opts ...MetricsOption) fasthttp.RequestHandler {
+	o := metricsOptions{
+		gatherer:    prometheus.DefaultGatherer,
+		compression: true,
+		openMetrics: true,
+	}
+	if gatherer, ok := h.registerer.(prometheus.Gatherer); ok {
+		o.gatherer = gatherer
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return h.metricsHandler(o)
+}
+
+func (h *handler) metricsHandler(o metricsOptions) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		ctx.SetUserValue(skipKey{}, true)
+		h.leaveInFlight(ctx)
+
+		families, err := o.gatherer.Gather()
+		if err != nil {
+			h.logger.Error("can't gather metrics", zap.Error(err))
+			ctx.Error("can't gather metrics: "+err.Error(), fasthttp.StatusInternalServerError)
+
+			return
+		}
+
+		header := http.Header{}
+		header.Set("Accept", string(ctx.Request.Header.Peek(fasthttp.HeaderAccept)))
+		format := expfmt.Negotiate(header)
+		if o.openMetrics {
+			format = expfmt.NegotiateIncludingOpenMetrics(header)
+		}
+		ctx.SetContentType(string(format))
+
+		var w io.Writer = ctx
+		if o.compression && ctx.Request.Header.HasAcceptEncoding("gzip") {
+			ctx.Response.Header.Set(fasthttp.HeaderContentEncoding, "gzip")
+			ctx.Response.Header.Add(fasthttp.HeaderVary, fasthttp.HeaderAcceptEncoding)
+
+			gz := gzip.NewWriter(ctx)
+			defer gz.Close()
+			w = gz
+		}
+
+		encoder := expfmt.NewEncoder(w, format)
+		for _, family := range families {
+			err = encoder.Encode(family)
+			if err != nil {
+				h.logger.Error("can't encode metric family", zap.String("name", family.GetName()), zap.Error(err))
+
+				return
+			}
+		}
+
+		if closer, ok := encoder.(expfmt.Closer); ok {
+			err = closer.Close()
+			if err != nil {
+				h.logger.Error("can't finalize metrics", zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package fasthttpprometheus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/suite"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+type metricsSuite struct {
+	suite.Suite
+
+	registry *prometheus.Registry
+	handler  *handler
+}
+
+func TestMetricsSuite(t *testing.T) {
+	suite.Run(t, &metricsSuite{})
+}
+
+func (s *metricsSuite) SetupTest() {
+	s.registry = prometheus.NewRegistry()
+	s.handler = NewHandler(fasthttprouter.New(), "test_service", zap.NewNop(), WithRegisterer(s.registry))
+	s.handler.GET("/ping", func(ctx *fasthttp.RequestCtx) {
+		ctx.SuccessString("text/plain; charset=utf-8", "PONG")
+	})
+	s.handler.Handler(newRequestCtx("GET", "/ping"))
+}
+
+func (s *metricsSuite) TestServeMetricsText() {
+	s.handler.ServeMetrics("/metrics")
+
+	ctx := newRequestCtx("GET", "/metrics")
+	s.handler.Handler(ctx)
+
+	s.Equal(fasthttp.StatusOK, ctx.Response.StatusCode())
+	s.Equal(string(expfmt.FmtText), string(ctx.Response.Header.ContentType()))
+	s.Empty(ctx.Response.Header.Peek(fasthttp.HeaderContentEncoding))
+	s.Contains(string(ctx.Response.Body()), "test_service_ping_requests_total{http_method=\"GET\"} 1\n")
+	s.NotContains(string(ctx.Response.Body()), "# EOF")
+}
+
+func (s *metricsSuite) TestServeMetricsOpenMetrics() {
+	s.handler.ServeMetrics("/metrics")
+
+	ctx := newRequestCtx("GET", "/metrics")
+	ctx.Request.Header.Set(fasthttp.HeaderAccept, "application/openmetrics-text; version=0.0.1")
+	s.handler.Handler(ctx)
+
+	s.Equal(fasthttp.StatusOK, ctx.Response.StatusCode())
+	s.Equal(string(expfmt.FmtOpenMetrics), string(ctx.Response.Header.ContentType()))
+	s.Contains(string(ctx.Response.Body()), "test_service_ping_requests_total{http_method=\"GET\"} 1.0\n")
+	s.True(strings.HasSuffix(string(ctx.Response.Body()), "# EOF\n"))
+}
+
+func (s *metricsSuite) TestServeMetricsWithoutOpenMetrics() {
+	s.handler.ServeMetrics("/metrics", WithoutOpenMetrics())
+
+	ctx := newRequestCtx("GET", "/metrics")
+	ctx.Request.Header.Set(fasthttp.HeaderAccept, "application/openmetrics-text; version=0.0.1")
+	s.handler.Handler(ctx)
+
+	s.Equal(string(expfmt.FmtText), string(ctx.Response.Header.ContentType()))
+}
+
+func (s *metricsSuite) TestServeMetricsGzip() {
+	s.handler.ServeMetrics("/metrics")
+
+	ctx := newRequestCtx("GET", "/metrics")
+	ctx.Request.Header.Set(fasthttp.HeaderAcceptEncoding, "gzip, deflate")
+	s.handler.Handler(ctx)
+
+	s.Equal("gzip", string(ctx.Response.Header.Peek(fasthttp.HeaderContentEncoding)))
+	reader, err := gzip.NewReader(bytes.NewReader(ctx.Response.Body()))
+	s.Nil(err)
+	body, err := io.ReadAll(reader)
+	s.Nil(err)
+	s.Contains(string(body), "test_service_ping_requests_total{http_method=\"GET\"} 1\n")
+}
+
+func (s *metricsSuite) TestServeMetricsWithoutCompression() {
+	s.handler.ServeMetrics("/metrics", WithoutCompression())
+
+	ctx := newRequestCtx("GET", "/metrics")
+	ctx.Request.Header.Set(fasthttp.HeaderAcceptEncoding, "gzip")
+	s.handler.Handler(ctx)
+
+	s.Empty(ctx.Response.Header.Peek(fasthttp.HeaderContentEncoding))
+	s.Contains(string(ctx.Response.Body()), "test_service_ping_requests_total{http_method=\"GET\"} 1\n")
+}
+
+func (s *metricsSuite) TestServeMetricsWithGatherer() {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "custom_total", Help: "Custom counter"})
+	registry.MustRegister(counter)
+	s.handler.ServeMetrics("/metrics", WithGatherer(registry))
+
+	ctx := newRequestCtx("GET", "/metrics")
+	s.handler.Handler(ctx)
+
+	s.Equal("# HELP custom_total Custom counter\n# TYPE custom_total counter\ncustom_total 0\n", string(ctx.Response.Body()))
+}
+
+func (s *metricsSuite) TestServeMetricsGatherErr() {
+	s.handler.ServeMetrics("/metrics", WithGatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return nil, errors.New("gather error")
+	})))
+
+	ctx := newRequestCtx("GET", "/metrics")
+	s.handler.Handler(ctx)
+
+	s.Equal(fasthttp.StatusInternalServerError, ctx.Response.StatusCode())
+}
+
+func (s *metricsSuite) TestServeMetricsNotInstrumented() {
+	// leaf for metrics path exists in the trie but requests to metrics endpoint must be skipped
+	s.handler.putMethod("/metrics", "GET")
+	s.handler.ServeMetrics("/metrics")
+
+	s.handler.Handler(newRequestCtx("GET", "/metrics"))
+
+	leaf := s.handler.routes()["GET"].getLeaf("/metrics")
+	s.Equal(float64(0), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+}
@@ -3,9 +3,17 @@ package fasthttpprometheus
 import (
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/buaazp/fasthttprouter"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
 )
@@ -17,24 +25,121 @@ const (
 	metricTypeTotal string = "total"
 	// metric type
 	metricTypeFailure string = "failure_total"
+	// metric type
+	metricTypeDuration string = "duration_seconds"
+	// metric type
+	metricTypeStatus string = "status_total"
+	// metric type
+	metricTypeStatusClass string = "status_class_total"
+	// metric type
+	metricTypeInFlight string = "in_flight"
+	// metric type
+	metricTypeRequestSize string = "request_size_bytes"
+	// metric type
+	metricTypeResponseSize string = "response_size_bytes"
+	// metric type
+	metricTypeRedirect string = "redirect_total"
+	// metric type
+	metricTypePanics string = "panics_total"
+)
+
+const (
+	// metric name of requests counter shared by all routes in labeled mode
+	labeledMetricTotal string = "http_requests_total"
+	// metric name of failed requests counter shared by all routes in labeled mode
+	labeledMetricFailure string = "http_requests_failure_total"
+	// metric name of request duration histogram shared by all routes in labeled mode
+	labeledMetricDuration string = "http_request_duration_seconds"
+	// metric name of in-flight requests gauge shared by all routes in labeled mode
+	labeledMetricInFlight string = "http_requests_in_flight"
+	// metric name of request size histogram shared by all routes in labeled mode
+	labeledMetricRequestSize string = "http_request_size_bytes"
+	// metric name of response size histogram shared by all routes in labeled mode
+	labeledMetricResponseSize string = "http_response_size_bytes"
+	// metric name of counter of requests redirected by router to routes shared by all routes in labeled mode
+	labeledMetricRedirect string = "http_requests_redirect_total"
+	// metric name of counter of panics of route handlers shared by all routes in labeled mode
+	labeledMetricPanics string = "http_requests_panics_total"
+
+	// metric name of service-wide in-flight requests gauge
+	metricInFlight string = "in_flight_requests"
+	// metric name of requests which don't match any registered route
+	metricUnmatched string = "unmatched_requests_total"
+	// metric name part of root route /
+	rootMetricName string = "root"
+
+	// label with route template, e.g. /user/:id
+	labelRoute string = "route"
+	// label with http method
+	labelMethod string = "method"
+	// label with response status code
+	labelStatus string = "status"
+	// label with response status code of per route status counter
+	labelCode string = "code"
+	// label with response status class (2xx, 3xx, 4xx, 5xx) of per route status class counter
+	labelClass string = "class"
+	// label with reason of unmatched request
+	labelReason string = "reason"
+)
+
+const (
+	// router answered 404 Not Found
+	reasonNotFound string = "not_found"
+	// router answered 405 Method Not Allowed
+	reasonMethodNotAllowed string = "method_not_allowed"
+
+	// method label value of unmatched requests with unknown http method
+	otherMethod string = "other"
+	// method of routes matching any method in fasthttp/router
+	methodWild string = "*"
 )
 
 const (
+	// byte for symbol "*"
+	asteriskByte uint8 = 42
 	// byte for symbol "-"
 	dashByte uint8 = 45
 	// byte for symbol "/"
 	slashByte uint8 = 47
 	// byte for symbol ":"
 	colonByte uint8 = 58
+	// byte for symbol "?"
+	questionByte uint8 = 63
 	// byte for symbol "_"
 	underlineByte uint8 = 95
+	// byte for symbol "{"
+	openBraceByte uint8 = 123
+	// byte for symbol "}"
+	closeBraceByte uint8 = 125
 )
 
 var (
 	metricNotFoundErr = errors.New("metric not found")
 )
 
+// routeKey marks requests dispatched by router to registered handler, its value is leaf of route
+type routeKey struct{}
+
+// panicKey marks requests which handler panicked, its value is recovered value
+type panicKey struct{}
+
+// unmatchedKey marks requests handled by NotFound or MethodNotAllowed handlers, its value is reason of unmatched request
+type unmatchedKey struct{}
+
+// inFlightKey marks requests counted by service-wide in-flight requests gauge, its value is handler counting request
+type inFlightKey struct{}
+
+// defaultSizeBuckets are buckets of request and response size histograms from 100B to 10MB
+var defaultSizeBuckets = prometheus.ExponentialBuckets(100, 10, 6)
+
 func processMetricName(path string, metricName *string) {
+	// root route has no parts to name metrics by
+	if len(path) == 1 {
+		if len(*metricName) == 0 {
+			*metricName = rootMetricName
+		}
+		return
+	}
 	if path[1] == colonByte {
 		if path[len(path)-1] == slashByte {
 			*metricName = *metricName + "_" + path[2:len(path)-1] + "_var"
@@ -43,6 +148,11 @@ func processMetricName(path string, metricName *string) {
 		}
 		return
 	}
+	// catch-all parameter is always the last part of route
+	if path[1] == asteriskByte {
+		*metricName = *metricName + "_" + path[2:] + "_all"
+		return
+	}
 
 	bytes := make([]byte, len(path), len(path))
 	for i := 0; i < len(path); i++ {
@@ -69,163 +179,1551 @@ func processMetricName(path string, metricName *string) {
 }
 
 type handler struct {
-	router  *fasthttprouter.Router
-	service string
-	trie    map[string]*node
-	logger  *zap.Logger
+	router          Router
+	service         string
+	logger          *zap.Logger
+	durationBuckets []float64
+	sizeBuckets     []float64
+	isFailure       FailureClassifier
+	registerer      prometheus.Registerer
+	namespace       string
+	subsystem       string
+	constLabels     prometheus.Labels
+	// if true all routes share metric families labeled by route, method and status
+	labeled       bool
+	vecs          map[string]*prometheus.CounterVec
+	histogramVecs map[string]*prometheus.HistogramVec
+	gaugeVecs     map[string]*prometheus.GaugeVec
+	// service-wide in-flight requests gauge
+	inFlight prometheus.Gauge
+	// counter of requests which don't match any registered route
+	unmatched *prometheus.CounterVec
+	// resolves route template of request instrumented by Middleware
+	resolveRoute RouteResolver
+	// trie of every http method published by copy-on-write, see routes
+	trie atomic.Pointer[map[string]*node]
+	// serializes route registration
+	mu sync.Mutex
+	// references to leaves of registered routes by http method and route template
+	leafRefs map[string]*atomic.Pointer[node]
+	// writes response of request which handler panicked, panic is re-raised if nil
+	recoverHandler func(ctx *fasthttp.RequestCtx, recovered interface{})
+	// errors of route registration reported by Validate
+	errs []error
+	// resolves collisions of metric names of routes
+	collisionStrategy CollisionStrategy
+	// route templates by metric name of requests counter, see resolveCollision
+	metricRoutes map[string]string
+	// hashes inserted into metric names of routes by http method and route template on collision
+	routeHashes map[string]string
+	// names per route metrics
+	namer MetricNamer
+	// help texts and const labels of per route metrics shared by routes by metric name, see metricOpts
+	shared map[string]*sharedMetric
+}
+
+func NewHandler(router *fasthttprouter.Router, service string, logger *zap.Logger, opts ...Option) *handler {
+	return NewRouterHandler(NewFasthttprouterAdapter(router), service, logger, opts...)
+}
+
+// NewRouterHandler returns handler of any router implementing Router,
+// e.g. NewRouterHandler(NewFasthttpRouterAdapter(router.New()), "service", logger).
+// Use NewMiddleware if router isn't owned by handler
+func NewRouterHandler(router Router, service string, logger *zap.Logger, opts ...Option) *handler {
+	if router == nil {
+		panic("fasthttp-prometheus: router must not be nil, use NewMiddleware to instrument handlers without router")
+	}
+
+	return newHandler(router, service, logger, opts...)
 }
 
-func NewHandler(router *fasthttprouter.Router, service string, logger *zap.Logger) *handler {
-	return &handler{
-		router:  router,
-		service: service,
-		trie:    make(map[string]*node, 0),
-		logger:  logger,
+// newHandler returns handler of router, router is nil in middleware mode
+func newHandler(router Router, service string, logger *zap.Logger, opts ...Option) *handler {
+	h := &handler{
+		router:          router,
+		service:         service,
+		logger:          logger,
+		durationBuckets: prometheus.DefBuckets,
+		sizeBuckets:     defaultSizeBuckets,
+		isFailure:       defaultFailureClassifier,
+		registerer:      prometheus.DefaultRegisterer,
+		namespace:       service,
+		leafRefs:        make(map[string]*atomic.Pointer[node]),
+		metricRoutes:    make(map[string]string),
+		routeHashes:     make(map[string]string),
+		shared:          make(map[string]*sharedMetric),
+	}
+	h.trie.Store(&map[string]*node{})
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.namer == nil {
+		h.namer = NewDefaultMetricNamer(h.namespace, h.subsystem)
+	}
+	h.setInFlight()
+	h.setUnmatched()
+	if h.labeled {
+		h.setVecs()
 	}
+
+	return h
+}
+
+// middleware instruments handlers of routers it doesn't own, e.g. router of third-party module,
+// so it provides no route registration methods (GET, Handle, ServeFiles etc.)
+type middleware struct {
+	handler *handler
+}
+
+// NewMiddleware returns middleware which doesn't own router, requests are instrumented by Middleware.
+// Routes must be declared by Declare or resolved by WithRouteResolver option
+func NewMiddleware(service string, logger *zap.Logger, opts ...Option) *middleware {
+	return &middleware{handler: newHandler(nil, service, logger, opts...)}
+}
+
+// Middleware instruments next handler, see handler.Middleware
+func (m *middleware) Middleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return m.handler.Middleware(next)
+}
+
+// Declare adds route to instrumented routes, see handler.Declare
+func (m *middleware) Declare(method, path string, opts ...RouteOption) {
+	m.handler.Declare(method, path, opts...)
+}
+
+// MustDeclare adds route to instrumented routes and panics if its metrics can't be registered,
+// see handler.MustDeclare
+func (m *middleware) MustDeclare(method, path string, opts ...RouteOption) {
+	m.handler.MustDeclare(method, path, opts...)
+}
+
+// Remove removes declared route and unregisters its metrics, see handler.Remove
+func (m *middleware) Remove(method, path string) bool {
+	return m.handler.Remove(method, path)
+}
+
+// Validate returns errors of routes which failed registration, see handler.Validate
+func (m *middleware) Validate() error {
+	return m.handler.Validate()
+}
+
+// MetricsHandler returns handler of metrics endpoint to be registered in router, see handler.MetricsHandler
+func (m *middleware) MetricsHandler(opts ...MetricsOption) fasthttp.RequestHandler {
+	return m.handler.MetricsHandler(opts...)
 }
 
+// Handler dispatches request by router and collects metrics of matched route,
+// route is known from registered handler called by router so request path isn't looked up
 func (h *handler) Handler(ctx *fasthttp.RequestCtx) {
+	h.enterInFlight(ctx)
+	// panic of route handler may be re-raised
+	defer h.leaveInFlight(ctx)
+
+	start := time.Now()
 	h.router.Handler(ctx)
-	h.libHandler(ctx)
+	duration := time.Since(start)
+
+	leaf, _ := ctx.UserValue(routeKey{}).(*node)
+	if leaf != nil && leaf.disabled {
+		return
+	}
+	h.collect(ctx, leaf, duration)
+}
+
+// Middleware instruments next handler, e.g. router of third-party module.
+// Route of request is resolved by resolver set by WithRouteResolver option,
+// otherwise request path is looked up among routes registered by Declare, GET and other methods
+func (h *handler) Middleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		h.serve(ctx, h.resolveLeaf(ctx), next)
+	}
+}
+
+// Declare adds route to instrumented routes without registering it in router,
+// e.g. for routes registered by third-party module and instrumented by Middleware.
+// If metrics of the route can't be registered, error is logged and reported by Validate
+func (h *handler) Declare(method, path string, opts ...RouteOption) {
+	// error is kept by putMethod to be reported by Validate
+	_ = h.putMethod(path, method, opts...)
+}
+
+// MustDeclare adds route to instrumented routes like Declare and panics with *RouteError
+// if metrics of the route can't be registered
+func (h *handler) MustDeclare(method, path string, opts ...RouteOption) {
+	err := h.putMethod(path, method, opts...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// serve calls next handler and collects metrics of the leaf
+func (h *handler) serve(ctx *fasthttp.RequestCtx, leaf *node, next fasthttp.RequestHandler) {
+	if leaf != nil && leaf.disabled {
+		next(ctx)
+
+		return
+	}
+
+	h.addInFlight(ctx, leaf, 1)
+	defer h.addInFlight(ctx, leaf, -1)
+
+	start := time.Now()
+	h.call(ctx, leaf, next, start)
+	h.collect(ctx, leaf, time.Since(start))
+}
+
+// call calls handle and records its panic
+func (h *handler) call(ctx *fasthttp.RequestCtx, leaf *node, handle fasthttp.RequestHandler, start time.Time) {
+	defer h.recoverPanic(ctx, leaf, start)
+
+	handle(ctx)
+}
+
+// recoverPanic counts panic of handle on the leaf, request is counted as failed with status 500.
+// Panic is recovered by handler set by WithPanicRecovery option,
+// otherwise request is collected at once and panic is re-raised
+func (h *handler) recoverPanic(ctx *fasthttp.RequestCtx, leaf *node, start time.Time) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	if leaf != nil {
+		err := h.incCounter(leaf, metricTypePanics, fasthttp.StatusInternalServerError)
+		if err != nil {
+			h.logger.Warn(
+				"can't find metric",
+				zap.ByteString("path", ctx.URI().Path()),
+				zap.ByteString("http_method", ctx.Method()),
+				zap.String("metric_type", metricTypePanics),
+			)
+		}
+	}
+	ctx.SetUserValue(panicKey{}, recovered)
+	ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+
+	if h.recoverHandler != nil {
+		h.recoverHandler(ctx, recovered)
+
+		return
+	}
+
+	// request isn't collected after panic is re-raised, e.g. by Handler if router recovers from panic
+	h.collect(ctx, leaf, time.Since(start))
+	ctx.SetUserValue(skipKey{}, true)
+
+	panic(recovered)
+}
+
+// defaultFailureClassifier marks request as failed if status_code >= 400
+func defaultFailureClassifier(ctx *fasthttp.RequestCtx) bool {
+	return ctx.Response.StatusCode() >= fasthttp.StatusBadRequest
+}
+
+func (h *handler) GET(path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	h.Handle(fasthttp.MethodGet, path, handle, opts...)
+}
+
+func (h *handler) HEAD(path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	h.Handle(fasthttp.MethodHead, path, handle, opts...)
+}
+
+func (h *handler) OPTIONS(path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	h.Handle(fasthttp.MethodOptions, path, handle, opts...)
+}
+
+func (h *handler) POST(path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	h.Handle(fasthttp.MethodPost, path, handle, opts...)
+}
+
+func (h *handler) PUT(path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	h.Handle(fasthttp.MethodPut, path, handle, opts...)
+}
+
+func (h *handler) PATCH(path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	h.Handle(fasthttp.MethodPatch, path, handle, opts...)
+}
+
+func (h *handler) DELETE(path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	h.Handle(fasthttp.MethodDelete, path, handle, opts...)
+}
+
+// Handle registers handle for the route with given method, e.g. custom methods like PROPFIND.
+// If metrics of the route can't be registered, error is logged and reported by Validate,
+// route is served without metrics
+func (h *handler) Handle(method, path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	// error is kept by putMethod to be reported by Validate
+	_ = h.putMethod(path, method, opts...)
+	h.router.Handle(method, path, h.instrument(h.leafRef(method, path), handle))
+}
+
+// Register registers handle for the route with given method like Handle
+// and returns *RouteError if metrics of the route can't be registered.
+// In that case route isn't registered in router
+func (h *handler) Register(method, path string, handle fasthttp.RequestHandler, opts ...RouteOption) error {
+	err := h.putMethod(path, method, opts...)
+	if err != nil {
+		return err
+	}
+	h.router.Handle(method, path, h.instrument(h.leafRef(method, path), handle))
+
+	return nil
+}
+
+// MustRegister registers handle for the route with given method like Register
+// and panics with *RouteError if metrics of the route can't be registered
+func (h *handler) MustRegister(method, path string, handle fasthttp.RequestHandler, opts ...RouteOption) {
+	err := h.Register(method, path, handle, opts...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ServeFiles serves files from rootPath on GET path which must end with catch-all parameter,
+// e.g. ServeFiles("/static/*filepath", "/var/www") or ServeFiles("/static/{filepath:*}", "/var/www")
+func (h *handler) ServeFiles(path string, rootPath string, opts ...RouteOption) {
+	h.Handle(fasthttp.MethodGet, path, h.router.FilesHandler(path, rootPath), opts...)
 }
 
-func (h *handler) GET(path string, handle fasthttp.RequestHandler) {
-	h.putMethod(path, "GET")
-	h.router.GET(path, handle)
+// instrument returns handle which marks request with leaf of the route and counts it in-flight
+func (h *handler) instrument(ref *atomic.Pointer[node], handle fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		leaf := ref.Load()
+		ctx.SetUserValue(routeKey{}, leaf)
+		if leaf == nil || leaf.disabled {
+			// requests of routes without instrumentation aren't in flight like in Middleware mode
+			h.leaveInFlight(ctx)
+			handle(ctx)
+
+			return
+		}
+
+		h.addRouteInFlight(ctx, leaf, 1)
+		// router may recover from panic of handle
+		defer h.addRouteInFlight(ctx, leaf, -1)
+
+		h.call(ctx, leaf, handle, time.Now())
+	}
 }
 
-func (h *handler) HEAD(path string, handle fasthttp.RequestHandler) {
-	h.putMethod(path, "HEAD")
-	h.router.HEAD(path, handle)
+// leafRef returns reference to the current leaf of route, nil if route is removed
+func (h *handler) leafRef(method, path string) *atomic.Pointer[node] {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.leafRefLocked(method, path)
 }
 
-func (h *handler) OPTIONS(path string, handle fasthttp.RequestHandler) {
-	h.putMethod(path, "OPTIONS")
-	h.router.OPTIONS(path, handle)
+func (h *handler) leafRefLocked(method, path string) *atomic.Pointer[node] {
+	key := method + " " + path
+	ref, ok := h.leafRefs[key]
+	if !ok {
+		ref = new(atomic.Pointer[node])
+		h.leafRefs[key] = ref
+	}
+
+	return ref
 }
 
-func (h *handler) POST(path string, handle fasthttp.RequestHandler) {
-	h.putMethod(path, "POST")
-	h.router.POST(path, handle)
+// Lookup allows the manual lookup of a method + path combo in the router
+func (h *handler) Lookup(method, path string, ctx *fasthttp.RequestCtx) (fasthttp.RequestHandler, bool) {
+	return h.router.Lookup(method, path, ctx)
 }
 
-func (h *handler) PUT(path string, handle fasthttp.RequestHandler) {
-	h.putMethod(path, "PUT")
-	h.router.PUT(path, handle)
+// NotFound sets handler of requests which don't match any route,
+// such requests are counted by unmatched counter with not_found reason whatever status code handler responds
+func (h *handler) NotFound(handler fasthttp.RequestHandler) {
+	h.router.SetNotFound(func(ctx *fasthttp.RequestCtx) {
+		ctx.SetUserValue(unmatchedKey{}, reasonNotFound)
+		handler(ctx)
+	})
 }
 
-func (h *handler) PATCH(path string, handle fasthttp.RequestHandler) {
-	h.putMethod(path, "PATCH")
-	h.router.PATCH(path, handle)
+// MethodNotAllowed sets handler of requests which match route registered for other methods only,
+// such requests are counted by unmatched counter with method_not_allowed reason whatever status code handler responds
+func (h *handler) MethodNotAllowed(handler fasthttp.RequestHandler) {
+	h.router.SetMethodNotAllowed(func(ctx *fasthttp.RequestCtx) {
+		ctx.SetUserValue(unmatchedKey{}, reasonMethodNotAllowed)
+		handler(ctx)
+	})
 }
 
-func (h *handler) DELETE(path string, handle fasthttp.RequestHandler) {
-	h.putMethod(path, "DELETE")
-	h.router.DELETE(path, handle)
+// PanicHandler sets handler of panics recovered by router from route handlers.
+// Panic is counted in metrics of the route as failed request with status 500 before panic handler is called,
+// WithPanicRecovery option recovers from panic before router does
+func (h *handler) PanicHandler(handler func(ctx *fasthttp.RequestCtx, recovered interface{})) {
+	h.router.SetPanicHandler(handler)
 }
 
-func (h *handler) putMethod(path, httpMethod string) {
+// putMethod adds route to the trie and registers its metrics,
+// error of registration is returned and kept to be reported by Validate
+func (h *handler) putMethod(path, httpMethod string, opts ...RouteOption) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			h.logger.Error(
 				"libfasthttp-prometheus recovered from panic",
 				zap.String("panic_msg", fmt.Sprintf("%v", r)),
 			)
+			err = fmt.Errorf("recovered from panic: %v", r)
+		}
+		if err != nil {
+			err = &RouteError{Method: httpMethod, Path: path, Err: err}
+
+			h.mu.Lock()
+			h.errs = append(h.errs, err)
+			h.mu.Unlock()
 		}
 	}()
 
-	root, ok := h.trie[httpMethod]
-	if !ok {
-		root = new(node)
-		h.trie[httpMethod] = root
+	// routes are registered in copy of trie which replaces published one,
+	// so requests are served without locks while routes are registered at runtime
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	root := new(node)
+	if published, ok := h.routes()[httpMethod]; ok {
+		root = published.clone()
+	}
+
+	var o routeOptions
+	for _, opt := range opts {
+		opt(&o)
 	}
 
+	// route with optional parameters matches several paths sharing metrics of full route,
+	// e.g. /user/{name?} matches /user and /user/{name}
+	paths := optionalPaths(path)
+	if ref, ok := h.leafRefs[httpMethod+" "+path]; ok && ref.Load() != nil {
+		if !ref.Load().disabled {
+			return ErrRouteRegistered
+		}
+
+		// route without metrics is replaced, e.g. registered again after metric name collision is resolved
+		for _, optionalPath := range paths {
+			root.removePath(normalizePath(optionalPath))
+		}
+	}
+	// errors of previous registration of the route are outdated, e.g. registration is retried after failure
+	h.pruneErrs(httpMethod, path)
 	var metricName string
-	leaf := root.addPath(path, &metricName)
-	h.setMetrics(
-		leaf,
-		h.createMetric(metricName, httpMethod, metricTypeTotal),
-		h.createMetric(metricName, httpMethod, metricTypeFailure),
-	)
+	leaf := root.addPath(normalizePath(paths[len(paths)-1]), &metricName)
+	err = h.setRouteMetrics(leaf, path, httpMethod, o)
+	for _, optionalPath := range paths[:len(paths)-1] {
+		var optionalMetricName string
+		root.addPath(normalizePath(optionalPath), &optionalMetricName).shareMetrics(leaf)
+	}
+
+	h.publish(httpMethod, root)
+	h.leafRefLocked(httpMethod, path).Store(leaf)
+
+	return err
 }
 
-func (h *handler) createMetric(metricName, httpMethod, metricType string) prometheus.Counter {
-	return prometheus.NewCounter(prometheus.CounterOpts{
-		Name:      fmt.Sprintf("%s_%s_%s", metricName, requests, metricType),
-		Namespace: h.service,
-		ConstLabels: prometheus.Labels{
-			"http_method": httpMethod,
-		},
-	})
+// Validate returns RegistrationErrors of all routes which failed registration so far, e.g. because of
+// metric name collisions, or nil. Routes which failed registration are served with incomplete metrics
+func (h *handler) Validate() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.errs) == 0 {
+		return nil
+	}
+
+	errs := make(RegistrationErrors, len(h.errs))
+	copy(errs, h.errs)
+
+	return errs
 }
 
-func (h *handler) setMetrics(leaf *node, metricTotal, metricFailure prometheus.Counter) {
-	leaf.metrics = map[string]prometheus.Counter{
-		metricTypeTotal:   metricTotal,
-		metricTypeFailure: metricFailure,
+// Remove removes route from instrumented routes and unregisters its metrics,
+// reports if route was registered. Route isn't removed from router which doesn't support it
+func (h *handler) Remove(method, path string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.pruneErrs(method, path)
+	published, ok := h.routes()[method]
+	if !ok {
+		return false
 	}
 
-	err := prometheus.Register(metricTotal)
-	if err != nil {
-		h.logger.Warn("can't register total metric", zap.Error(err))
+	root := published.clone()
+	paths := optionalPaths(path)
+	leaf := root.removePath(normalizePath(paths[len(paths)-1]))
+	if leaf == nil {
+		return false
+	}
+	for _, optionalPath := range paths[:len(paths)-1] {
+		root.removePath(normalizePath(optionalPath))
+	}
 
-		return
+	h.publish(method, root)
+	if ref, ok := h.leafRefs[method+" "+path]; ok {
+		ref.Store(nil)
 	}
+	h.unregisterLeaf(leaf, path, method)
+	h.releaseMetricNames(path, method)
 
-	err = prometheus.Register(metricFailure)
-	if err != nil {
-		h.logger.Warn("can't register failure metric", zap.Error(err))
+	return true
+}
+
+// pruneErrs drops errors of route registration, e.g. of removed route. It must be called under lock
+func (h *handler) pruneErrs(method, path string) {
+	errs := h.errs[:0]
+	for _, err := range h.errs {
+		var routeErr *RouteError
+		if errors.As(err, &routeErr) && routeErr.Method == method && routeErr.Path == path {
+			continue
+		}
+		errs = append(errs, err)
+	}
+	for i := len(errs); i < len(h.errs); i++ {
+		h.errs[i] = nil
 	}
+	h.errs = errs
 }
 
-func (h *handler) libHandler(ctx *fasthttp.RequestCtx) {
-	root, ok := h.trie[string(ctx.Method())]
-	if !ok {
-		h.logger.Error("can't find tree", zap.ByteString("http_method", ctx.Method()))
+// releaseMetricNames releases metric names reserved by route template unless it's registered for other http methods,
+// see resolveCollision. It must be called under lock
+func (h *handler) releaseMetricNames(path, httpMethod string) {
+	delete(h.routeHashes, httpMethod+" "+path)
+	for key, ref := range h.leafRefs {
+		leaf := ref.Load()
+		if key != httpMethod+" "+path && strings.HasSuffix(key, " "+path) && leaf != nil && !leaf.disabled {
+			return
+		}
+	}
 
+	for name, route := range h.metricRoutes {
+		if route == path {
+			delete(h.metricRoutes, name)
+		}
+	}
+}
+
+// routes returns published trie of every http method, it must not be modified
+func (h *handler) routes() map[string]*node {
+	return *h.trie.Load()
+}
+
+// publish replaces published trie with copy containing root of http method,
+// method without routes is removed. It must be called under lock
+func (h *handler) publish(httpMethod string, root *node) {
+	routes := make(map[string]*node, len(h.routes())+1)
+	for method, published := range h.routes() {
+		routes[method] = published
+	}
+	if len(root.children) > 0 {
+		routes[httpMethod] = root
+	} else {
+		delete(routes, httpMethod)
+	}
+
+	h.trie.Store(&routes)
+}
+
+// unregisterLeaf unregisters metrics of removed route,
+// in labeled mode series of the route are deleted from shared metric families
+func (h *handler) unregisterLeaf(leaf *node, path, httpMethod string) {
+	if leaf.disabled {
 		return
 	}
 
-	leaf := root.getLeaf(string(ctx.URI().Path()))
-	if leaf == nil {
+	if h.labeled {
+		labels := prometheus.Labels{
+			labelRoute:  path,
+			labelMethod: httpMethod,
+		}
+		for _, vec := range h.vecs {
+			vec.DeletePartialMatch(labels)
+		}
+		for _, vec := range h.histogramVecs {
+			vec.DeletePartialMatch(labels)
+		}
+		for _, vec := range h.gaugeVecs {
+			vec.DeletePartialMatch(labels)
+		}
+
 		return
 	}
 
-	err := h.inc(leaf.metrics, metricTypeTotal)
+	h.unregisterMetrics(leaf)
+	h.releaseSharedMetrics(path, httpMethod)
+}
+
+// unregisterMetrics unregisters per route metrics bound to the leaf
+func (h *handler) unregisterMetrics(leaf *node) {
+	for _, metric := range leaf.metrics {
+		h.registerer.Unregister(metric)
+	}
+	for _, vec := range leaf.vecs {
+		h.registerer.Unregister(vec)
+	}
+	for _, histogram := range leaf.histograms {
+		h.registerer.Unregister(histogram)
+	}
+	for _, gauge := range leaf.gauges {
+		h.registerer.Unregister(gauge)
+	}
+}
+
+// setRouteMetrics creates metrics of route and binds them to the leaf
+func (h *handler) setRouteMetrics(leaf *node, path, httpMethod string, o routeOptions) error {
+	if o.disabled {
+		leaf.disabled = true
+
+		return nil
+	}
+
+	leaf.isFailure = o.isFailure
+	if h.labeled {
+		if len(o.constLabels) > 0 {
+			h.logger.Warn(
+				"route const labels are ignored in labeled mode",
+				zap.String("path", path),
+				zap.String("http_method", httpMethod),
+			)
+		}
+		h.setLabeledMetrics(leaf, path, httpMethod)
+
+		return nil
+	}
+
+	err := h.validateRouteLabels(path, httpMethod, o.constLabels)
+	if err == nil {
+		err = h.resolveCollision(path, httpMethod)
+	}
+	if err == nil {
+		err = h.validateRouteHelps(path, httpMethod, o.helps)
+	}
+	if err == nil {
+		err = h.validateSharedLabels(path, httpMethod, o.constLabels)
+	}
 	if err != nil {
+		leaf.disabled = true
+		h.releaseMetricNames(path, httpMethod)
 		h.logger.Warn(
-			"can't find metric",
-			zap.ByteString("path", ctx.URI().Path()),
-			zap.ByteString("http_method", ctx.Method()),
-			zap.String("metric_type", metricTypeTotal),
+			"can't register route metrics",
+			zap.String("path", path),
+			zap.String("http_method", httpMethod),
+			zap.Error(err),
 		)
 
-		return
+		return err
 	}
 
-	// if status_code >= 400 it will be marked as error and increment fail metric
-	if ctx.Response.StatusCode() >= fasthttp.StatusBadRequest {
-		err = h.inc(leaf.metrics, metricTypeFailure)
+	// leaf binds only metrics registered successfully, so they are unregistered if route fails registration
+	leaf.metrics, leaf.vecs, leaf.histograms, leaf.gauges = nil, nil, nil, nil
+	leaf.disabled = false
+	if h.collisionStrategy == CollisionLabel {
+		labels := make(prometheus.Labels, len(o.constLabels)+1)
+		for name, value := range o.constLabels {
+			labels[name] = value
+		}
+		labels[labelRoute] = path
+		o.constLabels = labels
+	}
+	errs := []error{
+		h.setMetrics(
+			leaf,
+			h.createMetric(path, httpMethod, metricTypeTotal, o),
+			h.createMetric(path, httpMethod, metricTypeFailure, o),
+		),
+		h.setCounter(leaf, metricTypeRedirect, h.createMetric(path, httpMethod, metricTypeRedirect, o)),
+		h.setCounter(leaf, metricTypePanics, h.createMetric(path, httpMethod, metricTypePanics, o)),
+		h.setHistogram(
+			leaf,
+			metricTypeDuration,
+			h.createHistogram(path, httpMethod, metricTypeDuration, h.durationBuckets, o),
+		),
+		h.setHistogram(
+			leaf,
+			metricTypeRequestSize,
+			h.createHistogram(path, httpMethod, metricTypeRequestSize, h.sizeBuckets, o),
+		),
+		h.setHistogram(
+			leaf,
+			metricTypeResponseSize,
+			h.createHistogram(path, httpMethod, metricTypeResponseSize, h.sizeBuckets, o),
+		),
+		h.setVec(leaf, metricTypeStatus, h.createVec(path, httpMethod, metricTypeStatus, labelCode, o)),
+		h.setVec(leaf, metricTypeStatusClass, h.createVec(path, httpMethod, metricTypeStatusClass, labelClass, o)),
+		h.setGauge(leaf, metricTypeInFlight, h.createGauge(path, httpMethod, metricTypeInFlight, o)),
+	}
+	for _, err := range errs {
 		if err != nil {
-			h.logger.Warn(
-				"can't find metric",
-				zap.ByteString("path", ctx.URI().Path()),
-				zap.ByteString("http_method", ctx.Method()),
-				zap.String("metric_type", metricTypeFailure),
-			)
+			h.unregisterMetrics(leaf)
+			leaf.metrics, leaf.vecs, leaf.histograms, leaf.gauges = nil, nil, nil, nil
+			leaf.disabled = true
+			h.releaseSharedMetrics(path, httpMethod)
+			h.releaseMetricNames(path, httpMethod)
 
-			return
+			return err
 		}
 	}
+
+	return nil
 }
 
-func (h *handler) inc(metrics map[string]prometheus.Counter, metricType string) error {
-	metric, ok := metrics[metricType]
-	if !ok {
-		return metricNotFoundErr
+// validateRouteLabels returns ErrInvalidRouteLabel if const label of route has invalid name
+// or overrides label set by library, e.g. http_method of default metric namer or code of status counter
+func (h *handler) validateRouteLabels(path, httpMethod string, labels prometheus.Labels) error {
+	_, _, namerLabels := h.namer.MetricName(httpMethod, path, MetricTotal)
+	for _, name := range labelNames(labels) {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("%w: %q isn't valid label name", ErrInvalidRouteLabel, name)
+		}
+
+		_, ok := namerLabels[name]
+		if ok || name == labelCode || name == labelClass || (name == labelRoute && h.collisionStrategy == CollisionLabel) {
+			return fmt.Errorf("%w: %q is set by library", ErrInvalidRouteLabel, name)
+		}
 	}
 
-	metric.Inc()
+	return nil
+}
+
+// resolveCollision reserves metric name of route template which isn't taken by another template according to
+// collision strategy, ErrMetricNameCollision is returned if collision can't be resolved.
+// Routes of the same template share metric names whatever http method they have. It must be called under lock
+func (h *handler) resolveCollision(path, httpMethod string) error {
+	// routes with the same metric name are distinguished by route label
+	if h.collisionStrategy == CollisionLabel {
+		return nil
+	}
+
+	name, _, _ := h.namer.MetricName(httpMethod, path, MetricTotal)
+	if h.collides(name, path, httpMethod) && h.collisionStrategy == CollisionHashSuffix {
+		hash := routeHash(path)
+		name = insertHash(name, metricTypeTotal, hash)
+		h.routeHashes[httpMethod+" "+path] = hash
+	}
+	if h.collides(name, path, httpMethod) {
+		delete(h.routeHashes, httpMethod+" "+path)
+
+		return fmt.Errorf("%w: %s is taken by route %s", ErrMetricNameCollision, name, h.metricRoutes[name])
+	}
+	if _, ok := h.metricRoutes[name]; !ok {
+		h.metricRoutes[name] = path
+	}
+
+	return nil
+}
+
+// collides reports if metric name is taken by another route template,
+// unless metric namer distinguishes routes by const labels and describes them the same, e.g. by http_route label
+func (h *handler) collides(name, path, httpMethod string) bool {
+	route, ok := h.metricRoutes[name]
+	if !ok || route == path {
+		return false
+	}
+
+	_, help, labels := h.namer.MetricName(httpMethod, path, MetricTotal)
+	_, takenHelp, takenLabels := h.namer.MetricName(httpMethod, route, MetricTotal)
+	if help != takenHelp || len(labels) != len(takenLabels) {
+		return true
+	}
+	for label, value := range labels {
+		if takenValue, ok := takenLabels[label]; !ok || takenValue != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// routeHash returns short hash of route template inserted into metric names on collision
+func routeHash(path string) string {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(path))
+
+	return fmt.Sprintf("%08x", hash.Sum32())
+}
+
+// insertHash inserts hash of route template into metric name before metric type suffix,
+// e.g. service_user_info_requests_1a2b3c4d_total, or appends it if name has no such suffix
+func insertHash(name, metricType, hash string) string {
+	if strings.HasSuffix(name, "_"+metricType) {
+		return name[:len(name)-len(metricType)] + hash + "_" + metricType
+	}
+
+	return name + "_" + hash
+}
+
+// sharedMetric describes metrics with the same name registered by routes: registerer requires them to share
+// help text and const label names
+type sharedMetric struct {
+	help string
+	// sorted names of const labels
+	labels []string
+	// http method and template of route which registered the first metric
+	route string
+	// number of routes using the name
+	routes int
+}
+
+// metricName returns name of metric of route named by metric namer, hash is inserted on collision
+func (h *handler) metricName(path, httpMethod, metricType string) (string, string, prometheus.Labels) {
+	name, help, namerLabels := h.namer.MetricName(httpMethod, path, MetricKind(metricType))
+	if hash, ok := h.routeHashes[httpMethod+" "+path]; ok {
+		name = insertHash(name, metricType, hash)
+	}
+
+	return name, help, namerLabels
+}
+
+// metricOpts returns options of metric of route named by metric namer, help text may be overridden by route.
+// Metrics with the same name share help text of the first one because registerer requires it
+func (h *handler) metricOpts(path, httpMethod, metricType string, o routeOptions) prometheus.Opts {
+	name, help, namerLabels := h.metricName(path, httpMethod, metricType)
+	if routeHelp, ok := o.helps[MetricKind(metricType)]; ok {
+		help = routeHelp
+	}
+	labels := h.routeLabels(namerLabels, o.constLabels)
+	if shared, ok := h.shared[name]; ok {
+		help = shared.help
+		shared.routes++
+	} else {
+		h.shared[name] = &sharedMetric{
+			help:   help,
+			labels: labelNames(labels),
+			route:  httpMethod + " " + path,
+			routes: 1,
+		}
+	}
+
+	return prometheus.Opts{
+		Name:        name,
+		Help:        help,
+		ConstLabels: labels,
+	}
+}
+
+// validateRouteHelps returns ErrHelpConflict if help text overridden by route differs from help text
+// of metric with the same name registered before, e.g. of the same route with another http method
+func (h *handler) validateRouteHelps(path, httpMethod string, helps map[MetricKind]string) error {
+	kinds := make([]string, 0, len(helps))
+	for kind := range helps {
+		kinds = append(kinds, string(kind))
+	}
+	sort.Strings(kinds)
+
+	for _, kind := range kinds {
+		name, _, _ := h.metricName(path, httpMethod, kind)
+		if shared, ok := h.shared[name]; ok && shared.help != helps[MetricKind(kind)] {
+			return fmt.Errorf("%w: %s is described as %q", ErrHelpConflict, name, shared.help)
+		}
+	}
+
+	return nil
+}
+
+// validateSharedLabels returns ErrInvalidRouteLabel if const label names of metrics of route differ from
+// label names of metrics with the same name registered before, e.g. of the same route with another http method
+func (h *handler) validateSharedLabels(path, httpMethod string, routeLabels prometheus.Labels) error {
+	name, _, namerLabels := h.metricName(path, httpMethod, metricTypeTotal)
+	labels := h.routeLabels(namerLabels, routeLabels)
+	if h.collisionStrategy == CollisionLabel {
+		labels[labelRoute] = path
+	}
+
+	shared, ok := h.shared[name]
+	if !ok || strings.Join(shared.labels, ",") == strings.Join(labelNames(labels), ",") {
+		return nil
+	}
+
+	return fmt.Errorf(
+		"%w: const labels %v differ from labels %v of %s registered by route %s",
+		ErrInvalidRouteLabel,
+		labelNames(labels),
+		shared.labels,
+		name,
+		shared.route,
+	)
+}
+
+// labelNames returns sorted names of labels
+func labelNames(labels prometheus.Labels) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// releaseSharedMetrics releases metric names of every kind of removed route,
+// help text and const labels of the name are dropped with the last route using it.
+// It must be called under lock before hash of route is released
+func (h *handler) releaseSharedMetrics(path, httpMethod string) {
+	for kind := range defaultHelps {
+		name, _, _ := h.metricName(path, httpMethod, string(kind))
+		if shared, ok := h.shared[name]; ok {
+			shared.routes--
+			if shared.routes == 0 {
+				delete(h.shared, name)
+			}
+		}
+	}
+}
+
+func (h *handler) createMetric(path, httpMethod, metricType string, o routeOptions) prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts(h.metricOpts(path, httpMethod, metricType, o)))
+}
+
+// createVec creates counter with single variable label,
+// its children are created lazily on first occurrence of label value
+func (h *handler) createVec(path, httpMethod, metricType, label string, o routeOptions) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(
+		prometheus.CounterOpts(h.metricOpts(path, httpMethod, metricType, o)),
+		[]string{label},
+	)
+}
+
+func (h *handler) createGauge(path, httpMethod, metricType string, o routeOptions) prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts(h.metricOpts(path, httpMethod, metricType, o)))
+}
+
+func (h *handler) createHistogram(
+	path, httpMethod, metricType string,
+	buckets []float64,
+	o routeOptions,
+) prometheus.Histogram {
+	opts := h.metricOpts(path, httpMethod, metricType, o)
+
+	return prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:        opts.Name,
+		Help:        opts.Help,
+		ConstLabels: opts.ConstLabels,
+		Buckets:     buckets,
+	})
+}
+
+// routeLabels returns const labels of per route metric merged from handler, route and metric namer labels
+func (h *handler) routeLabels(namerLabels, routeLabels prometheus.Labels) prometheus.Labels {
+	labels := make(prometheus.Labels, len(h.constLabels)+len(routeLabels)+len(namerLabels))
+	for name, value := range h.constLabels {
+		labels[name] = value
+	}
+	for name, value := range routeLabels {
+		labels[name] = value
+	}
+	for name, value := range namerLabels {
+		labels[name] = value
+	}
+
+	return labels
+}
+
+func (h *handler) setMetrics(leaf *node, metricTotal, metricFailure prometheus.Counter) error {
+	if leaf.metrics == nil {
+		leaf.metrics = make(map[string]prometheus.Counter)
+	}
+
+	err := h.registerer.Register(metricTotal)
+	if err != nil {
+		h.logger.Warn("can't register total metric", zap.Error(err))
+
+		return fmt.Errorf("can't register %s metric: %w", metricTypeTotal, err)
+	}
+	leaf.metrics[metricTypeTotal] = metricTotal
+
+	err = h.registerer.Register(metricFailure)
+	if err != nil {
+		h.logger.Warn("can't register failure metric", zap.Error(err))
+
+		return fmt.Errorf("can't register %s metric: %w", metricTypeFailure, err)
+	}
+	leaf.metrics[metricTypeFailure] = metricFailure
+
+	return nil
+}
+
+func (h *handler) setCounter(leaf *node, metricType string, counter prometheus.Counter) error {
+	if leaf.metrics == nil {
+		leaf.metrics = make(map[string]prometheus.Counter)
+	}
+
+	err := h.registerer.Register(counter)
+	if err != nil {
+		h.logger.Warn("can't register counter metric", zap.String("metric_type", metricType), zap.Error(err))
+
+		return fmt.Errorf("can't register %s metric: %w", metricType, err)
+	}
+	leaf.metrics[metricType] = counter
+
+	return nil
+}
+
+func (h *handler) setHistogram(leaf *node, metricType string, histogram prometheus.Histogram) error {
+	if leaf.histograms == nil {
+		leaf.histograms = make(map[string]prometheus.Histogram, 1)
+	}
+
+	err := h.registerer.Register(histogram)
+	if err != nil {
+		h.logger.Warn("can't register histogram metric", zap.String("metric_type", metricType), zap.Error(err))
+
+		return fmt.Errorf("can't register %s metric: %w", metricType, err)
+	}
+	leaf.histograms[metricType] = histogram
+
+	return nil
+}
+
+func (h *handler) setVec(leaf *node, metricType string, vec *prometheus.CounterVec) error {
+	if leaf.vecs == nil {
+		leaf.vecs = make(map[string]*prometheus.CounterVec, 2)
+	}
+
+	err := h.registerer.Register(vec)
+	if err != nil {
+		h.logger.Warn("can't register status metric", zap.String("metric_type", metricType), zap.Error(err))
+
+		return fmt.Errorf("can't register %s metric: %w", metricType, err)
+	}
+	leaf.vecs[metricType] = vec
+
+	return nil
+}
+
+func (h *handler) setGauge(leaf *node, metricType string, gauge prometheus.Gauge) error {
+	if leaf.gauges == nil {
+		leaf.gauges = make(map[string]prometheus.Gauge, 1)
+	}
+
+	err := h.registerer.Register(gauge)
+	if err != nil {
+		h.logger.Warn("can't register gauge metric", zap.String("metric_type", metricType), zap.Error(err))
+
+		return fmt.Errorf("can't register %s metric: %w", metricType, err)
+	}
+	leaf.gauges[metricType] = gauge
+
+	return nil
+}
+
+// setInFlight creates and registers service-wide in-flight requests gauge
+func (h *handler) setInFlight() {
+	h.inFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        metricInFlight,
+		Help:        "HTTP requests being handled by the service",
+		Namespace:   h.namespace,
+		Subsystem:   h.subsystem,
+		ConstLabels: h.constLabels,
+	})
+
+	err := h.registerer.Register(h.inFlight)
+	if err != nil {
+		h.logger.Warn("can't register in-flight metric", zap.Error(err))
+	}
+}
+
+// setUnmatched creates and registers counter of requests which don't match any registered route
+func (h *handler) setUnmatched() {
+	h.unmatched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        metricUnmatched,
+		Help:        "HTTP requests which don't match any registered route by method and reason",
+		Namespace:   h.namespace,
+		Subsystem:   h.subsystem,
+		ConstLabels: h.constLabels,
+	}, []string{labelMethod, labelReason})
+
+	err := h.registerer.Register(h.unmatched)
+	if err != nil {
+		h.logger.Warn("can't register unmatched metric", zap.Error(err))
+	}
+}
+
+// setVecs creates and registers metric families shared by all routes in labeled mode
+func (h *handler) setVecs() {
+	h.vecs = map[string]*prometheus.CounterVec{
+		metricTypeTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        labeledMetricTotal,
+			Help:        "Total HTTP requests by route, method and status",
+			Namespace:   h.namespace,
+			Subsystem:   h.subsystem,
+			ConstLabels: h.constLabels,
+		}, []string{labelRoute, labelMethod, labelStatus}),
+		metricTypeFailure: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        labeledMetricFailure,
+			Help:        "Failed HTTP requests by route, method and status",
+			Namespace:   h.namespace,
+			Subsystem:   h.subsystem,
+			ConstLabels: h.constLabels,
+		}, []string{labelRoute, labelMethod, labelStatus}),
+		metricTypeRedirect: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        labeledMetricRedirect,
+			Help:        "HTTP requests redirected by router by route, method and status",
+			Namespace:   h.namespace,
+			Subsystem:   h.subsystem,
+			ConstLabels: h.constLabels,
+		}, []string{labelRoute, labelMethod, labelStatus}),
+		metricTypePanics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        labeledMetricPanics,
+			Help:        "Panics of route handlers by route, method and status",
+			Namespace:   h.namespace,
+			Subsystem:   h.subsystem,
+			ConstLabels: h.constLabels,
+		}, []string{labelRoute, labelMethod, labelStatus}),
+	}
+	h.histogramVecs = map[string]*prometheus.HistogramVec{
+		metricTypeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        labeledMetricDuration,
+			Help:        "Duration of HTTP requests in seconds by route and method",
+			Namespace:   h.namespace,
+			Subsystem:   h.subsystem,
+			ConstLabels: h.constLabels,
+			Buckets:     h.durationBuckets,
+		}, []string{labelRoute, labelMethod}),
+		metricTypeRequestSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        labeledMetricRequestSize,
+			Help:        "Size of HTTP requests in bytes by route and method",
+			Namespace:   h.namespace,
+			Subsystem:   h.subsystem,
+			ConstLabels: h.constLabels,
+			Buckets:     h.sizeBuckets,
+		}, []string{labelRoute, labelMethod}),
+		metricTypeResponseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        labeledMetricResponseSize,
+			Help:        "Size of HTTP responses in bytes by route and method",
+			Namespace:   h.namespace,
+			Subsystem:   h.subsystem,
+			ConstLabels: h.constLabels,
+			Buckets:     h.sizeBuckets,
+		}, []string{labelRoute, labelMethod}),
+	}
+	h.gaugeVecs = map[string]*prometheus.GaugeVec{
+		metricTypeInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        labeledMetricInFlight,
+			Help:        "HTTP requests being handled by route and method",
+			Namespace:   h.namespace,
+			Subsystem:   h.subsystem,
+			ConstLabels: h.constLabels,
+		}, []string{labelRoute, labelMethod}),
+	}
+
+	for metricType, vec := range h.vecs {
+		err := h.registerer.Register(vec)
+		if err != nil {
+			h.logger.Warn("can't register labeled metric", zap.String("metric_type", metricType), zap.Error(err))
+		}
+	}
+	for metricType, vec := range h.histogramVecs {
+		err := h.registerer.Register(vec)
+		if err != nil {
+			h.logger.Warn("can't register labeled metric", zap.String("metric_type", metricType), zap.Error(err))
+		}
+	}
+	for metricType, vec := range h.gaugeVecs {
+		err := h.registerer.Register(vec)
+		if err != nil {
+			h.logger.Warn("can't register labeled metric", zap.String("metric_type", metricType), zap.Error(err))
+		}
+	}
+}
+
+// setLabeledMetrics binds shared metric families to the leaf curried by route template and http method,
+// only status label is left to be resolved per request
+func (h *handler) setLabeledMetrics(leaf *node, path, httpMethod string) {
+	labels := prometheus.Labels{
+		labelRoute:  path,
+		labelMethod: httpMethod,
+	}
+
+	leaf.vecs = make(map[string]*prometheus.CounterVec, len(h.vecs))
+	for metricType, vec := range h.vecs {
+		leaf.vecs[metricType] = vec.MustCurryWith(labels)
+	}
+
+	leaf.histograms = make(map[string]prometheus.Histogram, len(h.histogramVecs))
+	for metricType, vec := range h.histogramVecs {
+		// HistogramVec always returns prometheus.Histogram under prometheus.Observer
+		leaf.histograms[metricType] = vec.With(labels).(prometheus.Histogram)
+	}
+
+	leaf.gauges = make(map[string]prometheus.Gauge, len(h.gaugeVecs))
+	for metricType, vec := range h.gaugeVecs {
+		leaf.gauges[metricType] = vec.With(labels)
+	}
+}
+
+// getLeaf returns leaf of requested route or nil if route is not registered,
+// routes registered for any method (fasthttp/router MethodWild) are looked up if method has no route
+func (h *handler) getLeaf(ctx *fasthttp.RequestCtx) *node {
+	return h.lookupLeaf(string(ctx.Method()), string(ctx.URI().Path()))
+}
+
+// resolveLeaf returns leaf of route template resolved by route resolver,
+// request path is looked up if resolver is not set
+func (h *handler) resolveLeaf(ctx *fasthttp.RequestCtx) *node {
+	if h.resolveRoute == nil {
+		return h.getLeaf(ctx)
+	}
+
+	route := h.resolveRoute(ctx)
+	if route == "" {
+		return nil
+	}
+
+	// parameters of template match themselves, e.g. /user/:id matches leaf of /user/:id
+	return h.lookupLeaf(string(ctx.Method()), normalizePath(route))
+}
+
+func (h *handler) lookupLeaf(method, path string) *node {
+	routes := h.routes()
+	if root, ok := routes[method]; ok {
+		if leaf := root.getLeaf(path); leaf != nil {
+			return leaf
+		}
+	}
+	if root, ok := routes[methodWild]; ok {
+		return root.getLeaf(path)
+	}
+
+	return nil
+}
+
+// addInFlight adds delta to service-wide and route in-flight requests gauges
+func (h *handler) addInFlight(ctx *fasthttp.RequestCtx, leaf *node, delta float64) {
+	if delta > 0 {
+		h.enterInFlight(ctx)
+	} else {
+		h.leaveInFlight(ctx)
+	}
+	if leaf == nil {
+		return
+	}
+
+	h.addRouteInFlight(ctx, leaf, delta)
+}
+
+// enterInFlight adds request to service-wide in-flight requests gauge
+func (h *handler) enterInFlight(ctx *fasthttp.RequestCtx) {
+	h.inFlight.Add(1)
+	ctx.SetUserValue(inFlightKey{}, h)
+}
+
+// leaveInFlight removes request from service-wide in-flight requests gauge once,
+// e.g. before request is handled by metrics endpoint or route without instrumentation
+func (h *handler) leaveInFlight(ctx *fasthttp.RequestCtx) {
+	if counter, _ := ctx.UserValue(inFlightKey{}).(*handler); counter != h {
+		return
+	}
+
+	h.inFlight.Add(-1)
+	ctx.RemoveUserValue(inFlightKey{})
+}
+
+// addRouteInFlight adds delta to route in-flight requests gauge
+func (h *handler) addRouteInFlight(ctx *fasthttp.RequestCtx, leaf *node, delta float64) {
+	err := h.addGauge(leaf.gauges, metricTypeInFlight, delta)
+	if err != nil {
+		h.logger.Warn(
+			"can't find metric",
+			zap.ByteString("path", ctx.URI().Path()),
+			zap.ByteString("http_method", ctx.Method()),
+			zap.String("metric_type", metricTypeInFlight),
+		)
+	}
+}
+
+// collect updates route metrics after request is handled
+func (h *handler) collect(ctx *fasthttp.RequestCtx, leaf *node, duration time.Duration) {
+	if ctx.UserValue(skipKey{}) != nil {
+		return
+	}
+	if leaf == nil {
+		if target := h.redirectLeaf(ctx); target != nil {
+			h.incRedirect(ctx, target)
+
+			return
+		}
+		h.incUnmatched(ctx)
+
+		return
+	}
+
+	err := h.incCounter(leaf, metricTypeTotal, ctx.Response.StatusCode())
+	if err != nil {
+		h.logger.Warn(
+			"can't find metric",
+			zap.ByteString("path", ctx.URI().Path()),
+			zap.ByteString("http_method", ctx.Method()),
+			zap.String("metric_type", metricTypeTotal),
+		)
+
+		return
+	}
+
+	err = h.observe(leaf.histograms, metricTypeDuration, duration.Seconds())
+	if err != nil {
+		h.logger.Warn(
+			"can't find metric",
+			zap.ByteString("path", ctx.URI().Path()),
+			zap.ByteString("http_method", ctx.Method()),
+			zap.String("metric_type", metricTypeDuration),
+		)
+	}
+
+	h.observeSizes(ctx, leaf)
+
+	// in labeled mode status code is already a label of total counter
+	if !h.labeled {
+		h.incStatus(ctx, leaf)
+	}
+
+	isFailure := h.isFailure
+	if leaf.isFailure != nil {
+		isFailure = leaf.isFailure
+	}
+	// request is failed if handler panicked whatever classifier decides
+	if isFailure(ctx) || ctx.UserValue(panicKey{}) != nil {
+		err = h.incCounter(leaf, metricTypeFailure, ctx.Response.StatusCode())
+		if err != nil {
+			h.logger.Warn(
+				"can't find metric",
+				zap.ByteString("path", ctx.URI().Path()),
+				zap.ByteString("http_method", ctx.Method()),
+				zap.String("metric_type", metricTypeFailure),
+			)
+
+			return
+		}
+	}
+}
+
+// redirectLeaf returns leaf of route which router redirected request to, e.g. /ping for /ping/ or /PING,
+// or nil if response isn't redirect of router to registered route. Router redirects GET request by 301
+// and other requests by 307 (fasthttprouter) or 308 (fasthttp/router) to request path with trailing slash
+// added or removed, or to cleaned path fixed case-insensitively
+func (h *handler) redirectLeaf(ctx *fasthttp.RequestCtx) *node {
+	// redirect written by NotFound or MethodNotAllowed handler isn't redirect of router
+	if ctx.UserValue(unmatchedKey{}) != nil {
+		return nil
+	}
+
+	method := string(ctx.Method())
+	if !isRouterRedirect(method, ctx.Response.StatusCode()) {
+		return nil
+	}
+
+	location := ctx.Response.Header.Peek(fasthttp.HeaderLocation)
+	if len(location) == 0 {
+		return nil
+	}
+	uri := fasthttp.AcquireURI()
+	ctx.URI().CopyTo(uri)
+	uri.UpdateBytes(location)
+	target := string(uri.Path())
+	fasthttp.ReleaseURI(uri)
+
+	path := string(ctx.Path())
+	if target != toggleTrailingSlash(path) && !isFixedPath(path, target) {
+		return nil
+	}
+
+	leaf := h.lookupLeaf(method, target)
+	if leaf == nil || leaf.disabled {
+		return nil
+	}
+
+	return leaf
+}
+
+// isRouterRedirect reports if status code is one router redirects request of http method by
+func isRouterRedirect(method string, statusCode int) bool {
+	if statusCode == fasthttp.StatusPermanentRedirect {
+		return true
+	}
+	if method == fasthttp.MethodGet {
+		return statusCode == fasthttp.StatusMovedPermanently
+	}
+
+	return statusCode == fasthttp.StatusTemporaryRedirect
+}
+
+// isFixedPath reports if target is path fixed the same way as router does before redirect:
+// path is cleaned (e.g. /../ is resolved), matched case-insensitively and with trailing slash added or removed
+func isFixedPath(path, target string) bool {
+	path = fasthttprouter.CleanPath(path)
+
+	return strings.EqualFold(target, path) || strings.EqualFold(target, toggleTrailingSlash(path))
+}
+
+// toggleTrailingSlash removes trailing slash of path or adds it if there is no one
+func toggleTrailingSlash(path string) string {
+	if len(path) > 1 && path[len(path)-1] == slashByte {
+		return path[:len(path)-1]
+	}
+
+	return path + "/"
+}
+
+// incRedirect increments redirect counter of route which router redirected request to
+func (h *handler) incRedirect(ctx *fasthttp.RequestCtx, leaf *node) {
+	err := h.incCounter(leaf, metricTypeRedirect, ctx.Response.StatusCode())
+	if err != nil {
+		h.logger.Warn(
+			"can't find metric",
+			zap.ByteString("path", ctx.URI().Path()),
+			zap.ByteString("http_method", ctx.Method()),
+			zap.String("metric_type", metricTypeRedirect),
+		)
+	}
+}
+
+// incUnmatched increments unmatched counter if router answered Not Found or Method Not Allowed
+func (h *handler) incUnmatched(ctx *fasthttp.RequestCtx) {
+	if reason, ok := ctx.UserValue(unmatchedKey{}).(string); ok {
+		h.unmatched.WithLabelValues(h.methodLabel(ctx.Method()), reason).Inc()
+
+		return
+	}
+
+	var reason string
+	switch ctx.Response.StatusCode() {
+	case fasthttp.StatusNotFound:
+		reason = reasonNotFound
+	case fasthttp.StatusMethodNotAllowed:
+		reason = reasonMethodNotAllowed
+	default:
+		return
+	}
+
+	h.unmatched.WithLabelValues(h.methodLabel(ctx.Method()), reason).Inc()
+}
+
+// methodLabel limits values of method label by standard and registered methods
+// to protect metrics from high cardinality caused by arbitrary methods of scanners
+func (h *handler) methodLabel(method []byte) string {
+	switch string(method) {
+	case fasthttp.MethodGet, fasthttp.MethodHead, fasthttp.MethodPost, fasthttp.MethodPut, fasthttp.MethodPatch,
+		fasthttp.MethodDelete, fasthttp.MethodConnect, fasthttp.MethodOptions, fasthttp.MethodTrace:
+		return string(method)
+	}
+	if _, ok := h.routes()[string(method)]; ok {
+		return string(method)
+	}
+
+	return otherMethod
+}
+
+// observeSizes observes request and response body sizes
+func (h *handler) observeSizes(ctx *fasthttp.RequestCtx, leaf *node) {
+	err := h.observe(leaf.histograms, metricTypeRequestSize, float64(requestSize(ctx)))
+	if err != nil {
+		h.logger.Warn(
+			"can't find metric",
+			zap.ByteString("path", ctx.URI().Path()),
+			zap.ByteString("http_method", ctx.Method()),
+			zap.String("metric_type", metricTypeRequestSize),
+		)
+	}
+
+	err = h.observe(leaf.histograms, metricTypeResponseSize, float64(len(ctx.Response.Body())))
+	if err != nil {
+		h.logger.Warn(
+			"can't find metric",
+			zap.ByteString("path", ctx.URI().Path()),
+			zap.ByteString("http_method", ctx.Method()),
+			zap.String("metric_type", metricTypeResponseSize),
+		)
+	}
+}
+
+// requestSize returns request body size,
+// Content-Length header is used if body is not read yet (e.g. request body streaming is enabled)
+func requestSize(ctx *fasthttp.RequestCtx) int {
+	size := len(ctx.Request.Body())
+	if contentLength := ctx.Request.Header.ContentLength(); contentLength > size {
+		return contentLength
+	}
+
+	return size
+}
+
+// incStatus increments per route counters labeled by exact status code and by status class
+func (h *handler) incStatus(ctx *fasthttp.RequestCtx, leaf *node) {
+	statusCode := ctx.Response.StatusCode()
+
+	err := h.incVec(leaf.vecs, metricTypeStatus, strconv.Itoa(statusCode))
+	if err != nil {
+		h.logger.Warn(
+			"can't find metric",
+			zap.ByteString("path", ctx.URI().Path()),
+			zap.ByteString("http_method", ctx.Method()),
+			zap.String("metric_type", metricTypeStatus),
+		)
+	}
+
+	err = h.incVec(leaf.vecs, metricTypeStatusClass, statusClass(statusCode))
+	if err != nil {
+		h.logger.Warn(
+			"can't find metric",
+			zap.ByteString("path", ctx.URI().Path()),
+			zap.ByteString("http_method", ctx.Method()),
+			zap.String("metric_type", metricTypeStatusClass),
+		)
+	}
+}
+
+// statusClass returns class of status code, e.g. 5xx for 503
+func statusClass(statusCode int) string {
+	return strconv.Itoa(statusCode/100) + "xx"
+}
+
+// incCounter increments route counter of metric type,
+// in labeled mode counter is resolved by response status code
+func (h *handler) incCounter(leaf *node, metricType string, statusCode int) error {
+	if h.labeled {
+		return h.incVec(leaf.vecs, metricType, strconv.Itoa(statusCode))
+	}
+
+	return h.inc(leaf.metrics, metricType)
+}
+
+func (h *handler) inc(metrics map[string]prometheus.Counter, metricType string) error {
+	metric, ok := metrics[metricType]
+	if !ok {
+		return metricNotFoundErr
+	}
+
+	metric.Inc()
+
+	return nil
+}
+
+func (h *handler) incVec(vecs map[string]*prometheus.CounterVec, metricType string, labelValues ...string) error {
+	vec, ok := vecs[metricType]
+	if !ok {
+		return metricNotFoundErr
+	}
+
+	vec.WithLabelValues(labelValues...).Inc()
+
+	return nil
+}
+
+func (h *handler) addGauge(gauges map[string]prometheus.Gauge, metricType string, delta float64) error {
+	gauge, ok := gauges[metricType]
+	if !ok {
+		return metricNotFoundErr
+	}
+
+	gauge.Add(delta)
+
+	return nil
+}
+
+func (h *handler) observe(histograms map[string]prometheus.Histogram, metricType string, value float64) error {
+	histogram, ok := histograms[metricType]
+	if !ok {
+		return metricNotFoundErr
+	}
+
+	histogram.Observe(value)
 
 	return nil
 }
@@ -2,10 +2,17 @@ package fasthttpprometheus
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/buaazp/fasthttprouter"
+	fastrouter "github.com/fasthttp/router"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 	"github.com/valyala/fasthttp"
@@ -61,25 +68,23 @@ func Benchmark(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		for method, urls := range routesMap {
 			for _, url := range urls {
-				header := fasthttp.RequestHeader{}
-				header.SetMethod(method)
-
-				uri := &fasthttp.URI{}
-				uri.SetPath(url)
-
-				req := fasthttp.Request{}
-				req.SetURI(uri)
-				req.Header = header
-
-				ctx := &fasthttp.RequestCtx{
-					Request: req,
-				}
-				h.Handler(ctx)
+				h.Handler(newRequestCtx(method, url))
 			}
 		}
 	}
 }
 
+func newRequestCtx(method, path string) *fasthttp.RequestCtx {
+	req := &fasthttp.Request{}
+	req.Header.SetMethod(method)
+	req.URI().SetPath(path)
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(req, nil, zap.NewStdLog(zap.NewNop()))
+
+	return ctx
+}
+
 func TestProcessMetricName(t *testing.T) {
 	var metricName string
 	processMetricName("/article/", &metricName)
@@ -93,6 +98,9 @@ func TestProcessMetricName(t *testing.T) {
 
 	processMetricName("/:name/", &metricName)
 	assert.Equal(t, "article_some_action_id_var_name_var", metricName)
+
+	processMetricName("/*filepath", &metricName)
+	assert.Equal(t, "article_some_action_id_var_name_var_filepath_all", metricName)
 }
 
 type handlerSuite struct {
@@ -109,7 +117,64 @@ func TestHandlerSuite(t *testing.T) {
 func (s *handlerSuite) SetupTest() {
 	var core zapcore.Core
 	core, s.obs = observer.New(zap.InfoLevel)
-	s.handler = NewHandler(fasthttprouter.New(), "test_service", zap.New(core))
+	s.handler = NewHandler(fasthttprouter.New(), "test_service", zap.New(core), WithRegisterer(prometheus.NewRegistry()))
+}
+
+func (s *handlerSuite) TestNewHandlerOptions() {
+	registry := prometheus.NewRegistry()
+	s.handler = NewHandler(
+		fasthttprouter.New(),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(registry),
+		WithNamespace("company"),
+		WithSubsystem("http"),
+		WithConstLabels(prometheus.Labels{"service": "test_service"}),
+	)
+	s.handler.GET("/ping", func(ctx *fasthttp.RequestCtx) {})
+
+	leaf := s.handler.routes()["GET"].getLeaf("/ping")
+	s.Equal(
+		"Desc{fqName: \"company_http_ping_requests_total\", "+
+			"help: \"Total requests to routes named ping\", "+
+			"constLabels: {http_method=\"GET\",service=\"test_service\"}, variableLabels: []}",
+		leaf.metrics[metricTypeTotal].Desc().String(),
+	)
+	s.Equal(
+		"Desc{fqName: \"company_http_ping_requests_duration_seconds\", "+
+			"help: \"Duration of requests to routes named ping in seconds\", "+
+			"constLabels: {http_method=\"GET\",service=\"test_service\"}, variableLabels: []}",
+		leaf.histograms[metricTypeDuration].Desc().String(),
+	)
+
+	s.handler.Handler(newRequestCtx("GET", "/ping"))
+	families, err := registry.Gather()
+	s.Nil(err)
+	names := make([]string, 0, len(families))
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	s.Equal([]string{
+		"company_http_in_flight_requests",
+		"company_http_ping_requests_duration_seconds",
+		"company_http_ping_requests_failure_total",
+		"company_http_ping_requests_in_flight",
+		"company_http_ping_requests_panics_total",
+		"company_http_ping_requests_redirect_total",
+		"company_http_ping_requests_request_size_bytes",
+		"company_http_ping_requests_response_size_bytes",
+		"company_http_ping_requests_status_class_total",
+		"company_http_ping_requests_status_total",
+		"company_http_ping_requests_total",
+	}, names)
+
+	// second handler with own registry doesn't collide with the first one
+	registry = prometheus.NewRegistry()
+	var core zapcore.Core
+	core, s.obs = observer.New(zap.InfoLevel)
+	s.handler = NewHandler(fasthttprouter.New(), "test_service", zap.New(core), WithRegisterer(registry))
+	s.handler.GET("/ping", func(ctx *fasthttp.RequestCtx) {})
+	s.Equal(0, s.obs.Len())
 }
 
 func (s *handlerSuite) TestHandler() {
@@ -120,24 +185,66 @@ func (s *handlerSuite) TestHandler() {
 		return
 	})
 
-	header := fasthttp.RequestHeader{}
-	header.SetMethod("GET")
+	ctx := newRequestCtx("GET", url)
+	s.handler.Handler(ctx)
 
-	uri := &fasthttp.URI{}
-	uri.SetPath(url)
+	s.Equal(fasthttp.StatusOK, ctx.Response.StatusCode())
+	s.Equal(0, s.obs.FilterMessage("can't find metric").Len())
+}
+
+func (s *handlerSuite) TestHandlerInFlight() {
+	var leaf *node
+	var inFlight, routeInFlight float64
+	s.handler.GET("/some-path-for-in-flight", func(ctx *fasthttp.RequestCtx) {
+		inFlight = testutil.ToFloat64(s.handler.inFlight)
+		routeInFlight = testutil.ToFloat64(leaf.gauges[metricTypeInFlight])
+	})
+	leaf = s.handler.routes()["GET"].getLeaf("/some-path-for-in-flight")
+
+	s.handler.Handler(newRequestCtx("GET", "/some-path-for-in-flight"))
 
-	req := fasthttp.Request{}
-	req.SetURI(uri)
-	req.Header = header
+	s.Equal(float64(1), inFlight)
+	s.Equal(float64(1), routeInFlight)
+	s.Equal(float64(0), testutil.ToFloat64(s.handler.inFlight))
+	s.Equal(float64(0), testutil.ToFloat64(leaf.gauges[metricTypeInFlight]))
 
-	ctx := &fasthttp.RequestCtx{
-		Request: req,
+	// requests to unknown routes are counted by service-wide gauge only
+	s.handler.GET("/some-path-for-unknown-in-flight", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.Handler(newRequestCtx("GET", "/unknown"))
+	s.Equal(float64(0), testutil.ToFloat64(s.handler.inFlight))
+}
+
+func (s *handlerSuite) TestHandlerInFlightConcurrent() {
+	const workers = 8
+	started := make(chan struct{}, workers)
+	release := make(chan struct{})
+	s.handler.GET("/some-path-for-concurrent-in-flight", func(ctx *fasthttp.RequestCtx) {
+		started <- struct{}{}
+		<-release
+	})
+	leaf := s.handler.routes()["GET"].getLeaf("/some-path-for-concurrent-in-flight")
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handler.Handler(newRequestCtx("GET", "/some-path-for-concurrent-in-flight"))
+		}()
+	}
+	for i := 0; i < workers; i++ {
+		<-started
 	}
 
-	s.handler.Handler(ctx)
+	s.Equal(float64(workers), testutil.ToFloat64(s.handler.inFlight))
+	s.Equal(float64(workers), testutil.ToFloat64(leaf.gauges[metricTypeInFlight]))
 
-	s.Equal(fasthttp.StatusOK, ctx.Response.StatusCode())
-	s.Equal(0, s.obs.FilterMessage("can't find metric").Len())
+	close(release)
+	wg.Wait()
+
+	s.Equal(float64(0), testutil.ToFloat64(s.handler.inFlight))
+	s.Equal(float64(0), testutil.ToFloat64(leaf.gauges[metricTypeInFlight]))
+	s.Equal(float64(workers), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
 }
 
 func (s *handlerSuite) TestGET() {
@@ -148,19 +255,24 @@ func (s *handlerSuite) TestGET() {
 		return
 	})
 
-	metrics := s.handler.trie["GET"].getLeaf("/ping").metrics
+	metrics := s.handler.routes()["GET"].getLeaf("/ping").metrics
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_total\", "+
+			"help: \"Total requests to routes named ping\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		metrics[metricTypeTotal].Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_failure_total\", "+
+			"help: \"Failed requests to routes named ping\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		metrics[metricTypeFailure].Desc().String(),
 	)
 
-	s.handler.trie["GET"].getLeaf("/ping").metrics = nil
+	s.handler.routes()["GET"].getLeaf("/ping").metrics = nil
+	s.handler.routes()["GET"].getLeaf("/ping").histograms = nil
+	s.handler.routes()["GET"].getLeaf("/ping").vecs = nil
+	s.handler.routes()["GET"].getLeaf("/ping").gauges = nil
 	s.Equal(map[string]*node{
 		"GET": {
 			children: []*node{
@@ -169,7 +281,7 @@ func (s *handlerSuite) TestGET() {
 				},
 			},
 		},
-	}, s.handler.trie)
+	}, s.handler.routes())
 }
 
 func (s *handlerSuite) TestHEAD() {
@@ -180,19 +292,24 @@ func (s *handlerSuite) TestHEAD() {
 		return
 	})
 
-	metrics := s.handler.trie["HEAD"].getLeaf("/ping").metrics
+	metrics := s.handler.routes()["HEAD"].getLeaf("/ping").metrics
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_total\", "+
+			"help: \"Total requests to routes named ping\", "+
 			"constLabels: {http_method=\"HEAD\"}, variableLabels: []}",
 		metrics[metricTypeTotal].Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_failure_total\", "+
+			"help: \"Failed requests to routes named ping\", "+
 			"constLabels: {http_method=\"HEAD\"}, variableLabels: []}",
 		metrics[metricTypeFailure].Desc().String(),
 	)
 
-	s.handler.trie["HEAD"].getLeaf("/ping").metrics = nil
+	s.handler.routes()["HEAD"].getLeaf("/ping").metrics = nil
+	s.handler.routes()["HEAD"].getLeaf("/ping").histograms = nil
+	s.handler.routes()["HEAD"].getLeaf("/ping").vecs = nil
+	s.handler.routes()["HEAD"].getLeaf("/ping").gauges = nil
 	s.Equal(map[string]*node{
 		"HEAD": {
 			children: []*node{
@@ -201,7 +318,7 @@ func (s *handlerSuite) TestHEAD() {
 				},
 			},
 		},
-	}, s.handler.trie)
+	}, s.handler.routes())
 }
 
 func (s *handlerSuite) TestOPTIONS() {
@@ -212,19 +329,24 @@ func (s *handlerSuite) TestOPTIONS() {
 		return
 	})
 
-	metrics := s.handler.trie["OPTIONS"].getLeaf("/ping").metrics
+	metrics := s.handler.routes()["OPTIONS"].getLeaf("/ping").metrics
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_total\", "+
+			"help: \"Total requests to routes named ping\", "+
 			"constLabels: {http_method=\"OPTIONS\"}, variableLabels: []}",
 		metrics[metricTypeTotal].Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_failure_total\", "+
+			"help: \"Failed requests to routes named ping\", "+
 			"constLabels: {http_method=\"OPTIONS\"}, variableLabels: []}",
 		metrics[metricTypeFailure].Desc().String(),
 	)
 
-	s.handler.trie["OPTIONS"].getLeaf("/ping").metrics = nil
+	s.handler.routes()["OPTIONS"].getLeaf("/ping").metrics = nil
+	s.handler.routes()["OPTIONS"].getLeaf("/ping").histograms = nil
+	s.handler.routes()["OPTIONS"].getLeaf("/ping").vecs = nil
+	s.handler.routes()["OPTIONS"].getLeaf("/ping").gauges = nil
 	s.Equal(map[string]*node{
 		"OPTIONS": {
 			children: []*node{
@@ -233,7 +355,7 @@ func (s *handlerSuite) TestOPTIONS() {
 				},
 			},
 		},
-	}, s.handler.trie)
+	}, s.handler.routes())
 }
 
 func (s *handlerSuite) TestPOST() {
@@ -244,19 +366,24 @@ func (s *handlerSuite) TestPOST() {
 		return
 	})
 
-	metrics := s.handler.trie["POST"].getLeaf("/ping").metrics
+	metrics := s.handler.routes()["POST"].getLeaf("/ping").metrics
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_total\", "+
+			"help: \"Total requests to routes named ping\", "+
 			"constLabels: {http_method=\"POST\"}, variableLabels: []}",
 		metrics[metricTypeTotal].Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_failure_total\", "+
+			"help: \"Failed requests to routes named ping\", "+
 			"constLabels: {http_method=\"POST\"}, variableLabels: []}",
 		metrics[metricTypeFailure].Desc().String(),
 	)
 
-	s.handler.trie["POST"].getLeaf("/ping").metrics = nil
+	s.handler.routes()["POST"].getLeaf("/ping").metrics = nil
+	s.handler.routes()["POST"].getLeaf("/ping").histograms = nil
+	s.handler.routes()["POST"].getLeaf("/ping").vecs = nil
+	s.handler.routes()["POST"].getLeaf("/ping").gauges = nil
 	s.Equal(map[string]*node{
 		"POST": {
 			children: []*node{
@@ -265,7 +392,7 @@ func (s *handlerSuite) TestPOST() {
 				},
 			},
 		},
-	}, s.handler.trie)
+	}, s.handler.routes())
 }
 
 func (s *handlerSuite) TestPUT() {
@@ -276,19 +403,24 @@ func (s *handlerSuite) TestPUT() {
 		return
 	})
 
-	metrics := s.handler.trie["PUT"].getLeaf("/ping").metrics
+	metrics := s.handler.routes()["PUT"].getLeaf("/ping").metrics
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_total\", "+
+			"help: \"Total requests to routes named ping\", "+
 			"constLabels: {http_method=\"PUT\"}, variableLabels: []}",
 		metrics[metricTypeTotal].Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_failure_total\", "+
+			"help: \"Failed requests to routes named ping\", "+
 			"constLabels: {http_method=\"PUT\"}, variableLabels: []}",
 		metrics[metricTypeFailure].Desc().String(),
 	)
 
-	s.handler.trie["PUT"].getLeaf("/ping").metrics = nil
+	s.handler.routes()["PUT"].getLeaf("/ping").metrics = nil
+	s.handler.routes()["PUT"].getLeaf("/ping").histograms = nil
+	s.handler.routes()["PUT"].getLeaf("/ping").vecs = nil
+	s.handler.routes()["PUT"].getLeaf("/ping").gauges = nil
 	s.Equal(map[string]*node{
 		"PUT": {
 			children: []*node{
@@ -297,7 +429,7 @@ func (s *handlerSuite) TestPUT() {
 				},
 			},
 		},
-	}, s.handler.trie)
+	}, s.handler.routes())
 }
 
 func (s *handlerSuite) TestPATCH() {
@@ -308,19 +440,24 @@ func (s *handlerSuite) TestPATCH() {
 		return
 	})
 
-	metrics := s.handler.trie["PATCH"].getLeaf("/ping").metrics
+	metrics := s.handler.routes()["PATCH"].getLeaf("/ping").metrics
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_total\", "+
+			"help: \"Total requests to routes named ping\", "+
 			"constLabels: {http_method=\"PATCH\"}, variableLabels: []}",
 		metrics[metricTypeTotal].Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_failure_total\", "+
+			"help: \"Failed requests to routes named ping\", "+
 			"constLabels: {http_method=\"PATCH\"}, variableLabels: []}",
 		metrics[metricTypeFailure].Desc().String(),
 	)
 
-	s.handler.trie["PATCH"].getLeaf("/ping").metrics = nil
+	s.handler.routes()["PATCH"].getLeaf("/ping").metrics = nil
+	s.handler.routes()["PATCH"].getLeaf("/ping").histograms = nil
+	s.handler.routes()["PATCH"].getLeaf("/ping").vecs = nil
+	s.handler.routes()["PATCH"].getLeaf("/ping").gauges = nil
 	s.Equal(map[string]*node{
 		"PATCH": {
 			children: []*node{
@@ -329,7 +466,7 @@ func (s *handlerSuite) TestPATCH() {
 				},
 			},
 		},
-	}, s.handler.trie)
+	}, s.handler.routes())
 }
 
 func (s *handlerSuite) TestDELETE() {
@@ -340,19 +477,24 @@ func (s *handlerSuite) TestDELETE() {
 		return
 	})
 
-	metrics := s.handler.trie["DELETE"].getLeaf("/ping").metrics
+	metrics := s.handler.routes()["DELETE"].getLeaf("/ping").metrics
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_total\", "+
+			"help: \"Total requests to routes named ping\", "+
 			"constLabels: {http_method=\"DELETE\"}, variableLabels: []}",
 		metrics[metricTypeTotal].Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_failure_total\", "+
+			"help: \"Failed requests to routes named ping\", "+
 			"constLabels: {http_method=\"DELETE\"}, variableLabels: []}",
 		metrics[metricTypeFailure].Desc().String(),
 	)
 
-	s.handler.trie["DELETE"].getLeaf("/ping").metrics = nil
+	s.handler.routes()["DELETE"].getLeaf("/ping").metrics = nil
+	s.handler.routes()["DELETE"].getLeaf("/ping").histograms = nil
+	s.handler.routes()["DELETE"].getLeaf("/ping").vecs = nil
+	s.handler.routes()["DELETE"].getLeaf("/ping").gauges = nil
 	s.Equal(map[string]*node{
 		"DELETE": {
 			children: []*node{
@@ -361,45 +503,225 @@ func (s *handlerSuite) TestDELETE() {
 				},
 			},
 		},
-	}, s.handler.trie)
+	}, s.handler.routes())
+}
+
+func (s *handlerSuite) TestHandle() {
+	s.handler.Handle("PROPFIND", "/dav/:file", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusMultiStatus)
+	})
+
+	ctx := newRequestCtx("PROPFIND", "/dav/readme.txt")
+	s.handler.Handler(ctx)
+
+	s.Equal(fasthttp.StatusMultiStatus, ctx.Response.StatusCode())
+	leaf := s.handler.routes()["PROPFIND"].getLeaf("/dav/readme.txt")
+	s.Equal(
+		"Desc{fqName: \"test_service_dav_file_var_requests_total\", "+
+			"help: \"Total requests to routes named dav_file_var\", "+
+			"constLabels: {http_method=\"PROPFIND\"}, variableLabels: []}",
+		leaf.metrics[metricTypeTotal].Desc().String(),
+	)
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+}
+
+func (s *handlerSuite) TestServeFiles() {
+	dir := s.T().TempDir()
+	s.Nil(os.WriteFile(filepath.Join(dir, "app.js"), []byte("console.log(1)"), 0o600))
+	s.handler.ServeFiles("/static/*filepath", dir)
+
+	ctx := newRequestCtx("GET", "/static/app.js")
+	s.handler.Handler(ctx)
+	s.Equal(fasthttp.StatusOK, ctx.Response.StatusCode())
+	s.Equal("console.log(1)", string(ctx.Response.Body()))
+
+	ctx = newRequestCtx("GET", "/static/none.js")
+	s.handler.Handler(ctx)
+	s.Equal(fasthttp.StatusNotFound, ctx.Response.StatusCode())
+
+	leaf := s.handler.routes()["GET"].getLeaf("/static/app.js")
+	s.Equal(float64(2), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeFailure]))
+	s.Equal(0, testutil.CollectAndCount(s.handler.unmatched))
+}
+
+func (s *handlerSuite) TestLookup() {
+	s.handler.GET("/user/:id", func(ctx *fasthttp.RequestCtx) {})
+
+	ctx := &fasthttp.RequestCtx{}
+	handle, tsr := s.handler.Lookup("GET", "/user/1", ctx)
+	s.NotNil(handle)
+	s.False(tsr)
+	s.Equal("1", ctx.UserValue("id"))
+
+	handle, tsr = s.handler.Lookup("GET", "/user/1/", ctx)
+	s.Nil(handle)
+	s.True(tsr)
+}
+
+func (s *handlerSuite) TestNotFound() {
+	s.handler.GET("/ping", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.NotFound(func(ctx *fasthttp.RequestCtx) {
+		ctx.SuccessString("text/html", "index.html")
+	})
+
+	ctx := newRequestCtx("GET", "/some/spa/page")
+	s.handler.Handler(ctx)
+
+	s.Equal(fasthttp.StatusOK, ctx.Response.StatusCode())
+	s.Equal("index.html", string(ctx.Response.Body()))
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.unmatched.WithLabelValues("GET", reasonNotFound)))
+}
+
+func (s *handlerSuite) TestMethodNotAllowed() {
+	s.handler.GET("/ping", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.MethodNotAllowed(func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	})
+
+	ctx := newRequestCtx("POST", "/ping")
+	s.handler.Handler(ctx)
+
+	s.Equal(fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+	s.Equal("GET, OPTIONS", string(ctx.Response.Header.Peek(fasthttp.HeaderAllow)))
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.unmatched.WithLabelValues("POST", reasonMethodNotAllowed)))
+}
+
+func (s *handlerSuite) TestPanicHandler() {
+	s.handler.GET("/panic", func(ctx *fasthttp.RequestCtx) {
+		panic("handler panic")
+	})
+	var recovered interface{}
+	s.handler.PanicHandler(func(ctx *fasthttp.RequestCtx, rcv interface{}) {
+		recovered = rcv
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+	})
+
+	s.handler.Handler(newRequestCtx("GET", "/panic"))
+
+	s.Equal("handler panic", recovered)
+	leaf := s.handler.routes()["GET"].getLeaf("/panic")
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeFailure]))
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypePanics]))
+	s.Equal(float64(0), testutil.ToFloat64(s.handler.inFlight))
+}
+
+func (s *handlerSuite) TestPanicRepanic() {
+	s.handler.GET("/panic", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusCreated)
+		panic("handler panic")
+	}, WithRouteFailureClassifier(func(ctx *fasthttp.RequestCtx) bool {
+		return false
+	}))
+
+	s.PanicsWithValue("handler panic", func() {
+		s.handler.Handler(newRequestCtx("GET", "/panic"))
+	})
+
+	leaf := s.handler.routes()["GET"].getLeaf("/panic")
+	s.Equal(
+		"Desc{fqName: \"test_service_panic_requests_panics_total\", "+
+			"help: \"Panics of handlers of routes named panic\", "+
+			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
+		leaf.metrics[metricTypePanics].Desc().String(),
+	)
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypePanics]))
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeFailure]))
+	s.Equal(float64(1), testutil.ToFloat64(leaf.vecs[metricTypeStatus].WithLabelValues("500")))
+	s.Equal(float64(0), testutil.ToFloat64(leaf.gauges[metricTypeInFlight]))
+	s.Equal(float64(0), testutil.ToFloat64(s.handler.inFlight))
+}
+
+func (s *handlerSuite) TestPanicRecovery() {
+	var recovered interface{}
+	s.handler = NewHandler(
+		fasthttprouter.New(),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(prometheus.NewRegistry()),
+		WithLabeledMetrics(),
+		WithPanicRecovery(func(ctx *fasthttp.RequestCtx, rcv interface{}) {
+			recovered = rcv
+			ctx.SetBodyString("internal error")
+		}),
+	)
+	s.handler.GET("/panic", func(ctx *fasthttp.RequestCtx) {
+		panic("handler panic")
+	})
+
+	ctx := newRequestCtx("GET", "/panic")
+	s.handler.Handler(ctx)
+
+	s.Equal("handler panic", recovered)
+	s.Equal(fasthttp.StatusInternalServerError, ctx.Response.StatusCode())
+	s.Equal("internal error", string(ctx.Response.Body()))
+	labels := []string{"/panic", "GET", "500"}
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.vecs[metricTypePanics].WithLabelValues(labels...)))
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.vecs[metricTypeTotal].WithLabelValues(labels...)))
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.vecs[metricTypeFailure].WithLabelValues(labels...)))
+}
+
+func (s *handlerSuite) TestMiddlewarePanic() {
+	s.handler = NewMiddleware("test_service", zap.NewNop(), WithRegisterer(prometheus.NewRegistry())).handler
+	s.handler.Declare("GET", "/panic")
+	next := s.handler.Middleware(func(ctx *fasthttp.RequestCtx) {
+		panic("handler panic")
+	})
+
+	s.PanicsWithValue("handler panic", func() {
+		next(newRequestCtx("GET", "/panic"))
+	})
+
+	leaf := s.handler.routes()["GET"].getLeaf("/panic")
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypePanics]))
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeFailure]))
+	s.Equal(float64(0), testutil.ToFloat64(s.handler.inFlight))
 }
 
 func (s *handlerSuite) TestCreateMetric() {
-	total := s.handler.createMetric("metric_name_one", "GET", metricTypeTotal)
-	fail := s.handler.createMetric("metric_name_one", "GET", metricTypeFailure)
+	total := s.handler.createMetric("/metric_name_one", "GET", metricTypeTotal, routeOptions{})
+	fail := s.handler.createMetric("/metric_name_one", "GET", metricTypeFailure, routeOptions{})
 	s.Equal(
-		"Desc{fqName: \"test_service_metric_name_one_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_metric_name_one_requests_total\", "+
+			"help: \"Total requests to routes named metric_name_one\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		total.Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_metric_name_one_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_metric_name_one_requests_failure_total\", "+
+			"help: \"Failed requests to routes named metric_name_one\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		fail.Desc().String(),
 	)
 
-	total = s.handler.createMetric("metric_name_two", "POST", metricTypeTotal)
-	fail = s.handler.createMetric("metric_name_two", "POST", metricTypeFailure)
+	total = s.handler.createMetric("/metric_name_two", "POST", metricTypeTotal, routeOptions{})
+	fail = s.handler.createMetric("/metric_name_two", "POST", metricTypeFailure, routeOptions{})
 	s.Equal(
-		"Desc{fqName: \"test_service_metric_name_two_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_metric_name_two_requests_total\", "+
+			"help: \"Total requests to routes named metric_name_two\", "+
 			"constLabels: {http_method=\"POST\"}, variableLabels: []}",
 		total.Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_metric_name_two_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_metric_name_two_requests_failure_total\", "+
+			"help: \"Failed requests to routes named metric_name_two\", "+
 			"constLabels: {http_method=\"POST\"}, variableLabels: []}",
 		fail.Desc().String(),
 	)
 
-	total = s.handler.createMetric("metric_name_three", "DELETE", metricTypeTotal)
-	fail = s.handler.createMetric("metric_name_three", "DELETE", metricTypeFailure)
+	total = s.handler.createMetric("/metric_name_three", "DELETE", metricTypeTotal, routeOptions{})
+	fail = s.handler.createMetric("/metric_name_three", "DELETE", metricTypeFailure, routeOptions{})
 	s.Equal(
-		"Desc{fqName: \"test_service_metric_name_three_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_metric_name_three_requests_total\", "+
+			"help: \"Total requests to routes named metric_name_three\", "+
 			"constLabels: {http_method=\"DELETE\"}, variableLabels: []}",
 		total.Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_metric_name_three_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_metric_name_three_requests_failure_total\", "+
+			"help: \"Failed requests to routes named metric_name_three\", "+
 			"constLabels: {http_method=\"DELETE\"}, variableLabels: []}",
 		fail.Desc().String(),
 	)
@@ -407,11 +729,11 @@ func (s *handlerSuite) TestCreateMetric() {
 
 func (s *handlerSuite) TestSetMetrics() {
 	leaf := node{path: "method-one"}
-	metricTotal := s.handler.createMetric("method_one", "GET", metricTypeTotal)
-	metricFailure := s.handler.createMetric("method_one", "GET", metricTypeFailure)
-	metricTotalTwo := s.handler.createMetric("method_two", "GET", metricTypeTotal)
-	metricFailureTwo := s.handler.createMetric("method_two", "GET", metricTypeFailure)
-	metricTotalThree := s.handler.createMetric("method_three", "GET", metricTypeTotal)
+	metricTotal := s.handler.createMetric("/method_one", "GET", metricTypeTotal, routeOptions{})
+	metricFailure := s.handler.createMetric("/method_one", "GET", metricTypeFailure, routeOptions{})
+	metricTotalTwo := s.handler.createMetric("/method_two", "GET", metricTypeTotal, routeOptions{})
+	metricFailureTwo := s.handler.createMetric("/method_two", "GET", metricTypeFailure, routeOptions{})
+	metricTotalThree := s.handler.createMetric("/method_three", "GET", metricTypeTotal, routeOptions{})
 
 	s.handler.setMetrics(&leaf, metricTotal, metricFailure)
 	s.handler.setMetrics(&leaf, metricTotal, metricFailure)
@@ -419,12 +741,14 @@ func (s *handlerSuite) TestSetMetrics() {
 	s.handler.setMetrics(&leaf, metricTotalThree, metricFailureTwo)
 
 	s.Equal(
-		"Desc{fqName: \"test_service_method_three_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_method_three_requests_total\", "+
+			"help: \"Total requests to routes named method_three\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		leaf.metrics[metricTypeTotal].Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_method_two_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_method_two_requests_failure_total\", "+
+			"help: \"Failed requests to routes named method_two\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		leaf.metrics[metricTypeFailure].Desc().String(),
 	)
@@ -434,17 +758,418 @@ func (s *handlerSuite) TestSetMetrics() {
 
 func (s *handlerSuite) TestPutMethodPanic() {
 	h := s.handler
-	h.trie = nil
+	h.trie.Store(nil)
 
-	h.putMethod("/user/:id", "GET")
+	err := h.putMethod("/user/:id", "GET")
 
 	s.Equal(
 		1,
 		s.obs.
 			FilterMessage("libfasthttp-prometheus recovered from panic").
-			FilterField(zap.String("panic_msg", "assignment to entry in nil map")).
+			FilterField(zap.String("panic_msg", "runtime error: invalid memory address or nil pointer dereference")).
 			Len(),
 	)
+	s.EqualError(
+		err,
+		"can't register route GET /user/:id: "+
+			"recovered from panic: runtime error: invalid memory address or nil pointer dereference",
+	)
+}
+
+func (s *handlerSuite) TestRegisterCollision() {
+	s.NoError(s.handler.Register("GET", "/user-info", func(ctx *fasthttp.RequestCtx) {}))
+
+	err := s.handler.Register("GET", "/user_info", func(ctx *fasthttp.RequestCtx) {})
+
+	var routeErr *RouteError
+	s.Require().ErrorAs(err, &routeErr)
+	s.Equal("GET", routeErr.Method)
+	s.Equal("/user_info", routeErr.Path)
+	s.ErrorIs(err, ErrMetricNameCollision)
+	s.EqualError(
+		err,
+		"can't register route GET /user_info: metric name collision: "+
+			"test_service_user_info_requests_total is taken by route /user-info",
+	)
+	s.Equal(1, s.obs.FilterMessage("can't register route metrics").Len())
+	s.True(s.handler.routes()["GET"].getLeaf("/user_info").disabled)
+	// routes of the same template share metric names whatever http method they have
+	s.NoError(s.handler.Register("POST", "/user-info", func(ctx *fasthttp.RequestCtx) {}))
+	s.ErrorIs(s.handler.Register("POST", "/user_info", func(ctx *fasthttp.RequestCtx) {}), ErrMetricNameCollision)
+
+	handle, _ := s.handler.Lookup("GET", "/user_info", &fasthttp.RequestCtx{})
+	s.Nil(handle)
+	s.handler.GET("/user_info", func(ctx *fasthttp.RequestCtx) {})
+	handle, _ = s.handler.Lookup("GET", "/user_info", &fasthttp.RequestCtx{})
+	s.NotNil(handle)
+}
+
+func (s *handlerSuite) TestMustRegister() {
+	s.handler.MustRegister("GET", "/user-info", func(ctx *fasthttp.RequestCtx) {})
+	// registration methods don't panic
+	s.handler.GET("/user_info", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.Declare("POST", "/user_info")
+	s.handler.Declare("POST", "/user-info")
+
+	s.PanicsWithError(
+		"can't register route PUT /user_info: metric name collision: "+
+			"test_service_user_info_requests_total is taken by route /user-info",
+		func() {
+			s.handler.MustRegister("PUT", "/user-info", func(ctx *fasthttp.RequestCtx) {})
+			s.handler.MustRegister("PUT", "/user_info", func(ctx *fasthttp.RequestCtx) {})
+		},
+	)
+	s.Panics(func() {
+		s.handler.MustDeclare("DELETE", "/user_info")
+		s.handler.MustDeclare("DELETE", "/user-info")
+	})
+}
+
+func (s *handlerSuite) TestRegisterRollback() {
+	registry := prometheus.NewRegistry()
+	s.handler = NewHandler(fasthttprouter.New(), "test_service", zap.NewNop(), WithRegisterer(registry))
+	taken := prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        "test_service_ping_requests_panics_total",
+		Help:        "Panics of handlers of routes named ping",
+		ConstLabels: prometheus.Labels{"http_method": "GET"},
+	})
+	s.Require().NoError(registry.Register(taken))
+
+	err := s.handler.Register("GET", "/ping", func(ctx *fasthttp.RequestCtx) {})
+
+	s.Error(err)
+	// metrics registered before failure are unregistered
+	s.Equal(0, testutil.CollectAndCount(registry, "test_service_ping_requests_total"))
+	s.Equal(1, testutil.CollectAndCount(registry, "test_service_ping_requests_panics_total"))
+	s.Empty(s.handler.metricRoutes)
+	// route isn't registered in router
+	handle, _ := s.handler.Lookup("GET", "/ping", &fasthttp.RequestCtx{})
+	s.Nil(handle)
+
+	registry.Unregister(taken)
+	s.NoError(s.handler.Register("GET", "/ping", func(ctx *fasthttp.RequestCtx) {}))
+	s.handler.Handler(newRequestCtx("GET", "/ping"))
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.routes()["GET"].getLeaf("/ping").metrics[metricTypeTotal]))
+}
+
+func (s *handlerSuite) TestCollisionHashSuffix() {
+	registry := prometheus.NewRegistry()
+	s.handler = NewRouterHandler(
+		NewFasthttpRouterAdapter(fastrouter.New()),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(registry),
+		WithCollisionStrategy(CollisionHashSuffix),
+	)
+	s.handler.GET("/a/{b}", func(ctx *fasthttp.RequestCtx) {})
+	s.NoError(s.handler.Register("GET", "/a/b_var", func(ctx *fasthttp.RequestCtx) {}))
+
+	s.Equal(
+		"Desc{fqName: \"test_service_a_b_var_requests_total\", "+
+			"help: \"Total requests to routes named a_b_var\", "+
+			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
+		s.handler.routes()["GET"].getLeaf("/a/1").metrics[metricTypeTotal].Desc().String(),
+	)
+	s.Equal(
+		"Desc{fqName: \"test_service_a_b_var_requests_"+routeHash("/a/b_var")+"_total\", "+
+			"help: \"Total requests to routes named a_b_var\", "+
+			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
+		s.handler.routes()["GET"].getLeaf("/a/b_var").metrics[metricTypeTotal].Desc().String(),
+	)
+	s.Len(s.handler.metricRoutes, 2)
+}
+
+func TestRouteHash(t *testing.T) {
+	assert.Len(t, routeHash("/user_info"), 8)
+	assert.Equal(t, routeHash("/user_info"), routeHash("/user_info"))
+	assert.NotEqual(t, routeHash("/user_info"), routeHash("/user-info"))
+}
+
+func (s *handlerSuite) TestCollisionLabel() {
+	registry := prometheus.NewRegistry()
+	s.handler = NewHandler(
+		fasthttprouter.New(),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(registry),
+		WithCollisionStrategy(CollisionLabel),
+	)
+	s.NoError(s.handler.Register("GET", "/user-info", func(ctx *fasthttp.RequestCtx) {}))
+	s.NoError(s.handler.Register("GET", "/user_info", func(ctx *fasthttp.RequestCtx) {}))
+
+	s.handler.Handler(newRequestCtx("GET", "/user-info"))
+	s.handler.Handler(newRequestCtx("GET", "/user_info"))
+	s.handler.Handler(newRequestCtx("GET", "/user_info"))
+
+	userDashInfo := s.handler.routes()["GET"].getLeaf("/user-info").metrics[metricTypeTotal]
+	userInfo := s.handler.routes()["GET"].getLeaf("/user_info").metrics[metricTypeTotal]
+	// metrics with the same name are described the same whatever route template they have
+	for route, counter := range map[string]prometheus.Counter{"/user-info": userDashInfo, "/user_info": userInfo} {
+		s.Equal(
+			"Desc{fqName: \"test_service_user_info_requests_total\", "+
+				"help: \"Total requests to routes named user_info\", "+
+				"constLabels: {http_method=\"GET\",route=\""+route+"\"}, variableLabels: []}",
+			counter.Desc().String(),
+		)
+	}
+	s.Equal(float64(1), testutil.ToFloat64(userDashInfo))
+	s.Equal(float64(2), testutil.ToFloat64(userInfo))
+	s.Equal(2, testutil.CollectAndCount(registry, "test_service_user_info_requests_total"))
+	s.Empty(s.handler.metricRoutes)
+}
+
+func (s *handlerSuite) TestCollisionRemove() {
+	// registerer keeps help text of removed metrics, default help text doesn't depend on route template,
+	// so metric name is reused by route with another template
+	s.handler.GET("/user-info", func(ctx *fasthttp.RequestCtx) {})
+	s.ErrorIs(s.handler.Register("GET", "/user_info", func(ctx *fasthttp.RequestCtx) {}), ErrMetricNameCollision)
+	s.True(s.handler.Remove("GET", "/user-info"))
+
+	s.NoError(s.handler.Register("GET", "/user_info", func(ctx *fasthttp.RequestCtx) {}))
+	s.Equal(
+		map[string]string{"test_service_user_info_requests_total": "/user_info"},
+		s.handler.metricRoutes,
+	)
+	s.handler.Handler(newRequestCtx("GET", "/user_info"))
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.routes()["GET"].getLeaf("/user_info").metrics[metricTypeTotal]))
+}
+
+func (s *handlerSuite) TestCollisionRemoveMethod() {
+	s.handler.GET("/user-info", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.POST("/user-info", func(ctx *fasthttp.RequestCtx) {})
+
+	// metric name is reserved while route template is registered for any http method
+	s.True(s.handler.Remove("GET", "/user-info"))
+	s.ErrorIs(s.handler.Register("GET", "/user_info", func(ctx *fasthttp.RequestCtx) {}), ErrMetricNameCollision)
+
+	s.True(s.handler.Remove("POST", "/user-info"))
+	s.Empty(s.handler.metricRoutes)
+}
+
+func (s *handlerSuite) TestCollisionRouteConstLabels() {
+	s.NoError(s.handler.Register(
+		"GET",
+		"/user-info",
+		func(ctx *fasthttp.RequestCtx) {},
+		WithRouteConstLabels(prometheus.Labels{"team": "a"}),
+	))
+
+	err := s.handler.Register(
+		"GET",
+		"/user_info",
+		func(ctx *fasthttp.RequestCtx) {},
+		WithRouteConstLabels(prometheus.Labels{"team": "b"}),
+	)
+
+	s.ErrorIs(err, ErrMetricNameCollision)
+
+	s.SetupTest()
+	s.handler = NewHandler(
+		fasthttprouter.New(),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(prometheus.NewRegistry()),
+		WithCollisionStrategy(CollisionHashSuffix),
+	)
+	s.NoError(s.handler.Register(
+		"GET",
+		"/user-info",
+		func(ctx *fasthttp.RequestCtx) {},
+		WithRouteConstLabels(prometheus.Labels{"team": "a"}),
+	))
+	s.NoError(s.handler.Register(
+		"POST",
+		"/user_info",
+		func(ctx *fasthttp.RequestCtx) {},
+		WithRouteConstLabels(prometheus.Labels{"team": "b"}),
+	))
+	s.Equal(
+		map[string]string{
+			"test_service_user_info_requests_total":                                 "/user-info",
+			"test_service_user_info_requests_" + routeHash("/user_info") + "_total": "/user_info",
+		},
+		s.handler.metricRoutes,
+	)
+}
+
+func (s *handlerSuite) TestRouteHelp() {
+	s.handler.GET(
+		"/user/:id",
+		func(ctx *fasthttp.RequestCtx) {},
+		WithRouteHelp(MetricTotal, "Total requests of user profile"),
+		WithRouteHelp(MetricDuration, "Duration of requests of user profile in seconds"),
+	)
+
+	leaf := s.handler.routes()["GET"].getLeaf("/user/1")
+	s.Contains(leaf.metrics[metricTypeTotal].Desc().String(), `help: "Total requests of user profile"`)
+	s.Contains(
+		leaf.histograms[metricTypeDuration].Desc().String(),
+		`help: "Duration of requests of user profile in seconds"`,
+	)
+	s.Contains(leaf.metrics[metricTypeFailure].Desc().String(), `help: "Failed requests to routes named user_id_var"`)
+}
+
+func (s *handlerSuite) TestSharedHelp() {
+	s.NoError(s.handler.Register("GET", "/user/:id", func(ctx *fasthttp.RequestCtx) {}))
+	s.NoError(s.handler.Register("POST", "/user/:id", func(ctx *fasthttp.RequestCtx) {}))
+	s.NoError(s.handler.Register(
+		"PUT",
+		"/user/:id",
+		func(ctx *fasthttp.RequestCtx) {},
+		WithRouteHelp(MetricTotal, "Total requests to routes named user_id_var"),
+	))
+
+	err := s.handler.Register(
+		"PATCH",
+		"/user/:id",
+		func(ctx *fasthttp.RequestCtx) {},
+		WithRouteHelp(MetricTotal, "Total updates of user"),
+	)
+
+	s.ErrorIs(err, ErrHelpConflict)
+	s.EqualError(
+		err,
+		"can't register route PATCH /user/:id: help text conflict: "+
+			"test_service_user_id_var_requests_total is described as \"Total requests to routes named user_id_var\"",
+	)
+	leaf := s.handler.routes()["POST"].getLeaf("/user/1")
+	s.Contains(leaf.metrics[metricTypeTotal].Desc().String(), `help: "Total requests to routes named user_id_var"`)
+	s.Contains(leaf.metrics[metricTypeFailure].Desc().String(), `help: "Failed requests to routes named user_id_var"`)
+	s.Contains(s.handler.inFlight.Desc().String(), `help: "HTTP requests being handled by the service"`)
+	s.Equal(3, s.handler.shared["test_service_user_id_var_requests_total"].routes)
+
+	// help text is dropped with the last route using it
+	s.True(s.handler.Remove("GET", "/user/:id"))
+	s.True(s.handler.Remove("POST", "/user/:id"))
+	s.Len(s.handler.shared, len(defaultHelps))
+	s.True(s.handler.Remove("PUT", "/user/:id"))
+	s.Empty(s.handler.shared)
+}
+
+func (s *handlerSuite) TestRouteConstLabels() {
+	s.handler = NewHandler(
+		fasthttprouter.New(),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(prometheus.NewRegistry()),
+		WithConstLabels(prometheus.Labels{"team": "platform", "env": "test"}),
+	)
+	s.NoError(s.handler.Register(
+		"GET",
+		"/user/:id",
+		func(ctx *fasthttp.RequestCtx) {},
+		WithRouteConstLabels(prometheus.Labels{"team": "core", "tier": "critical"}),
+	))
+
+	leaf := s.handler.routes()["GET"].getLeaf("/user/1")
+	s.Contains(
+		leaf.vecs[metricTypeStatus].WithLabelValues("200").Desc().String(),
+		`constLabels: {env="test",http_method="GET",team="core",tier="critical"}`,
+	)
+}
+
+func (s *handlerSuite) TestRouteConstLabelsMethods() {
+	s.NoError(s.handler.Register(
+		"GET",
+		"/user/:id",
+		func(ctx *fasthttp.RequestCtx) {},
+		WithRouteConstLabels(prometheus.Labels{"team": "a"}),
+	))
+
+	err := s.handler.Register("POST", "/user/:id", func(ctx *fasthttp.RequestCtx) {})
+
+	s.ErrorIs(err, ErrInvalidRouteLabel)
+	s.EqualError(
+		err,
+		"can't register route POST /user/:id: invalid route label: const labels [http_method] differ "+
+			"from labels [http_method team] of test_service_user_id_var_requests_total registered by route GET /user/:id",
+	)
+	s.NoError(s.handler.Register(
+		"PUT",
+		"/user/:id",
+		func(ctx *fasthttp.RequestCtx) {},
+		WithRouteConstLabels(prometheus.Labels{"team": "b"}),
+	))
+
+	s.handler.Handler(newRequestCtx("GET", "/user/1"))
+	s.handler.Handler(newRequestCtx("PUT", "/user/1"))
+	for method, team := range map[string]string{"GET": "a", "PUT": "b"} {
+		leaf := s.handler.routes()[method].getLeaf("/user/1")
+		s.Equal(
+			"Desc{fqName: \"test_service_user_id_var_requests_total\", help: \"Total requests to routes named user_id_var\", "+
+				"constLabels: {http_method=\""+method+"\",team=\""+team+"\"}, variableLabels: []}",
+			leaf.metrics[metricTypeTotal].Desc().String(),
+		)
+		s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	}
+}
+
+func (s *handlerSuite) TestRouteConstLabelsInvalid() {
+	for label, expectedErr := range map[string]string{
+		"http_method": `can't register route GET /user/:id: invalid route label: "http_method" is set by library`,
+		"code":        `can't register route GET /user/:id: invalid route label: "code" is set by library`,
+		"class":       `can't register route GET /user/:id: invalid route label: "class" is set by library`,
+		"1team":       `can't register route GET /user/:id: invalid route label: "1team" isn't valid label name`,
+		"__team":      `can't register route GET /user/:id: invalid route label: "__team" isn't valid label name`,
+	} {
+		s.SetupTest()
+		err := s.handler.Register(
+			"GET",
+			"/user/:id",
+			func(ctx *fasthttp.RequestCtx) {},
+			WithRouteConstLabels(prometheus.Labels{"team": "core", label: "value"}),
+		)
+
+		s.ErrorIs(err, ErrInvalidRouteLabel)
+		s.EqualError(err, expectedErr)
+		s.True(s.handler.routes()["GET"].getLeaf("/user/1").disabled)
+	}
+
+	s.SetupTest()
+	s.NoError(s.handler.Register(
+		"GET",
+		"/user/:id",
+		func(ctx *fasthttp.RequestCtx) {},
+		WithRouteConstLabels(prometheus.Labels{"route": "user"}),
+	))
+}
+
+func (s *handlerSuite) TestValidate() {
+	s.handler.GET("/user/:id", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.GET("/user-info", func(ctx *fasthttp.RequestCtx) {})
+	s.NoError(s.handler.Validate())
+
+	s.handler.GET("/user_info", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.Declare("POST", "/user/:id")
+	s.handler.Declare("POST", "/user/:id")
+
+	err := s.handler.Validate()
+	var errs RegistrationErrors
+	s.Require().ErrorAs(err, &errs)
+	s.Len(errs, 2)
+	s.ErrorContains(errs[0], "can't register route GET /user_info")
+	s.ErrorIs(errs[1], ErrRouteRegistered)
+	s.EqualError(errs[1], "can't register route POST /user/:id: route is already registered")
+
+	// errors of removed route are dropped
+	s.True(s.handler.Remove("GET", "/user_info"))
+	err = s.handler.Validate()
+	s.Require().ErrorAs(err, &errs)
+	s.Len(errs, 1)
+	s.False(s.handler.Remove("PUT", "/user/:id"))
+	s.True(s.handler.Remove("POST", "/user/:id"))
+	s.NoError(s.handler.Validate())
+}
+
+func (s *handlerSuite) TestValidateRetry() {
+	team := WithRouteConstLabels(prometheus.Labels{"team": "core"})
+	s.handler.GET("/user/:id", func(ctx *fasthttp.RequestCtx) {}, team)
+	s.ErrorIs(s.handler.Register("POST", "/user/:id", func(ctx *fasthttp.RequestCtx) {}), ErrInvalidRouteLabel)
+	s.ErrorIs(s.handler.Validate(), ErrInvalidRouteLabel)
+
+	// error of failed registration is dropped once route is registered
+	s.NoError(s.handler.Register("POST", "/user/:id", func(ctx *fasthttp.RequestCtx) {}, team))
+	s.NoError(s.handler.Validate())
 }
 
 func (s *handlerSuite) TestPutMethodOk() {
@@ -456,98 +1181,181 @@ func (s *handlerSuite) TestPutMethodOk() {
 	s.handler.putMethod("/ping", "GET")
 	s.handler.putMethod("/article/some-action/:id", "GET")
 
-	leaf := s.handler.trie["GET"].getLeaf("/user/:id")
+	leaf := s.handler.routes()["GET"].getLeaf("/user/:id")
 	s.Equal("/:id", leaf.path)
 	s.Equal(
-		"Desc{fqName: \"test_service_user_id_var_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_user_id_var_requests_total\", "+
+			"help: \"Total requests to routes named user_id_var\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		leaf.metrics[metricTypeTotal].Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_user_id_var_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_user_id_var_requests_failure_total\", "+
+			"help: \"Failed requests to routes named user_id_var\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		leaf.metrics[metricTypeFailure].Desc().String(),
 	)
 
-	leaf = s.handler.trie["POST"].getLeaf("/user/:id")
+	leaf = s.handler.routes()["POST"].getLeaf("/user/:id")
 	s.Equal("/:id", leaf.path)
 	s.Equal(
-		"Desc{fqName: \"test_service_user_id_var_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_user_id_var_requests_total\", "+
+			"help: \"Total requests to routes named user_id_var\", "+
 			"constLabels: {http_method=\"POST\"}, variableLabels: []}",
 		leaf.metrics[metricTypeTotal].Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_user_id_var_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_user_id_var_requests_failure_total\", "+
+			"help: \"Failed requests to routes named user_id_var\", "+
 			"constLabels: {http_method=\"POST\"}, variableLabels: []}",
 		leaf.metrics[metricTypeFailure].Desc().String(),
 	)
 
-	leaf = s.handler.trie["DELETE"].getLeaf("/user/:id")
+	leaf = s.handler.routes()["DELETE"].getLeaf("/user/:id")
 	s.Equal("/:id", leaf.path)
 	s.Equal(
-		"Desc{fqName: \"test_service_user_id_var_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_user_id_var_requests_total\", "+
+			"help: \"Total requests to routes named user_id_var\", "+
 			"constLabels: {http_method=\"DELETE\"}, variableLabels: []}",
 		leaf.metrics[metricTypeTotal].Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_user_id_var_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_user_id_var_requests_failure_total\", "+
+			"help: \"Failed requests to routes named user_id_var\", "+
 			"constLabels: {http_method=\"DELETE\"}, variableLabels: []}",
 		leaf.metrics[metricTypeFailure].Desc().String(),
 	)
 
-	leaf = s.handler.trie["GET"].getLeaf("/user/:id/some-method-one")
+	leaf = s.handler.routes()["GET"].getLeaf("/user/:id/some-method-one")
 	s.Equal("/some-method-one", leaf.path)
 	s.Equal(
-		"Desc{fqName: \"test_service_user_id_var_some_method_one_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_user_id_var_some_method_one_requests_total\", "+
+			"help: \"Total requests to routes named user_id_var_some_method_one\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		leaf.metrics[metricTypeTotal].Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_user_id_var_some_method_one_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_user_id_var_some_method_one_requests_failure_total\", "+
+			"help: \"Failed requests to routes named user_id_var_some_method_one\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		leaf.metrics[metricTypeFailure].Desc().String(),
 	)
 
-	leaf = s.handler.trie["GET"].getLeaf("/ping")
+	leaf = s.handler.routes()["GET"].getLeaf("/ping")
 	s.Equal("/ping", leaf.path)
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_duration_seconds\", "+
+			"help: \"Duration of requests to routes named ping in seconds\", "+
+			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
+		leaf.histograms[metricTypeDuration].Desc().String(),
+	)
+	s.Equal(
+		"Desc{fqName: \"test_service_ping_requests_total\", "+
+			"help: \"Total requests to routes named ping\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		leaf.metrics[metricTypeTotal].Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_ping_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_ping_requests_failure_total\", "+
+			"help: \"Failed requests to routes named ping\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		leaf.metrics[metricTypeFailure].Desc().String(),
 	)
 
-	leaf = s.handler.trie["GET"].getLeaf("/user/:id/some-method-two")
+	leaf = s.handler.routes()["GET"].getLeaf("/user/:id/some-method-two")
 	s.Equal("/some-method-two", leaf.path)
 	s.Equal(
-		"Desc{fqName: \"test_service_user_id_var_some_method_two_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_user_id_var_some_method_two_requests_total\", "+
+			"help: \"Total requests to routes named user_id_var_some_method_two\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		leaf.metrics[metricTypeTotal].Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_user_id_var_some_method_two_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_user_id_var_some_method_two_requests_failure_total\", "+
+			"help: \"Failed requests to routes named user_id_var_some_method_two\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		leaf.metrics[metricTypeFailure].Desc().String(),
 	)
 
-	leaf = s.handler.trie["GET"].getLeaf("/article/some-action/:id")
+	leaf = s.handler.routes()["GET"].getLeaf("/article/some-action/:id")
 	s.Equal("/:id", leaf.path)
 	s.Equal(
-		"Desc{fqName: \"test_service_article_some_action_id_var_requests_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_article_some_action_id_var_requests_total\", "+
+			"help: \"Total requests to routes named article_some_action_id_var\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		leaf.metrics[metricTypeTotal].Desc().String(),
 	)
 	s.Equal(
-		"Desc{fqName: \"test_service_article_some_action_id_var_requests_failure_total\", help: \"\", "+
+		"Desc{fqName: \"test_service_article_some_action_id_var_requests_failure_total\", "+
+			"help: \"Failed requests to routes named article_some_action_id_var\", "+
 			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
 		leaf.metrics[metricTypeFailure].Desc().String(),
 	)
 }
 
+func (s *handlerSuite) TestCreateHistogram() {
+	duration := s.handler.createHistogram(
+		"/metric_name_one",
+		"GET",
+		metricTypeDuration,
+		s.handler.durationBuckets,
+		routeOptions{},
+	)
+	s.Equal(
+		"Desc{fqName: \"test_service_metric_name_one_requests_duration_seconds\", "+
+			"help: \"Duration of requests to routes named metric_name_one in seconds\", "+
+			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
+		duration.Desc().String(),
+	)
+
+	s.handler = NewHandler(
+		fasthttprouter.New(),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(prometheus.NewRegistry()),
+		WithDurationBuckets([]float64{0.1, 1}),
+	)
+	duration = s.handler.createHistogram(
+		"/metric_name_one",
+		"GET",
+		metricTypeDuration,
+		s.handler.durationBuckets,
+		routeOptions{},
+	)
+	duration.Observe(0.5)
+
+	metric := &dto.Metric{}
+	s.Nil(duration.Write(metric))
+	s.Len(metric.GetHistogram().GetBucket(), 2)
+	s.Equal(uint64(0), metric.GetHistogram().GetBucket()[0].GetCumulativeCount())
+	s.Equal(uint64(1), metric.GetHistogram().GetBucket()[1].GetCumulativeCount())
+}
+
+func (s *handlerSuite) TestCreateVec() {
+	status := s.handler.createVec("/metric_name_one", "GET", metricTypeStatus, labelCode, routeOptions{})
+	s.Equal(
+		"Desc{fqName: \"test_service_metric_name_one_requests_status_total\", "+
+			"help: \"Requests to routes named metric_name_one by status code\", "+
+			"constLabels: {http_method=\"GET\"}, variableLabels: [{code <nil>}]}",
+		(<-s.describe(status)).String(),
+	)
+
+	class := s.handler.createVec("/metric_name_one", "GET", metricTypeStatusClass, labelClass, routeOptions{})
+	s.Equal(
+		"Desc{fqName: \"test_service_metric_name_one_requests_status_class_total\", "+
+			"help: \"Requests to routes named metric_name_one by status class\", "+
+			"constLabels: {http_method=\"GET\"}, variableLabels: [{class <nil>}]}",
+		(<-s.describe(class)).String(),
+	)
+}
+
+func (s *handlerSuite) TestObserveNotFound() {
+	histograms := map[string]prometheus.Histogram{}
+	err := s.handler.observe(histograms, metricTypeDuration, 1)
+
+	s.Equal(metricNotFoundErr, err)
+}
+
 func (s *handlerSuite) TestIncNotFound() {
 	metrics := map[string]prometheus.Counter{}
 	err := s.handler.inc(metrics, metricTypeTotal)
@@ -570,61 +1378,439 @@ func (s *handlerSuite) TestIncOk() {
 	s.Nil(err)
 }
 
-func (s *handlerSuite) TestLibHandlerFindTreeErr() {
-	header := fasthttp.RequestHeader{}
-	header.SetMethod("GET")
+func (s *handlerSuite) TestCollectFindTreeErr() {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("GET")
+	ctx.Response.SetStatusCode(fasthttp.StatusNotFound)
+	s.handler.collect(ctx, s.handler.getLeaf(ctx), time.Millisecond)
+
+	s.Equal(0, s.obs.Len())
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.unmatched.WithLabelValues("GET", reasonNotFound)))
+}
+
+func (s *handlerSuite) TestCollectFindLeafErr() {
+	s.handler.putMethod("/some-path-for-leaf-err", "GET")
+
+	ctx := newRequestCtx("GET", "/find-leaf")
+	ctx.Response.SetStatusCode(fasthttp.StatusNotFound)
+	s.handler.collect(ctx, s.handler.getLeaf(ctx), time.Millisecond)
+
+	s.Equal(0, s.obs.FilterMessage("can't find metric").Len())
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.unmatched.WithLabelValues("GET", reasonNotFound)))
+}
 
-	req := fasthttp.Request{}
-	req.Header = header
-	s.handler.libHandler(&fasthttp.RequestCtx{
-		Request: req,
+func (s *handlerSuite) TestHandlerCatchAll() {
+	s.handler.GET("/static/*filepath", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusOK)
 	})
 
+	s.handler.Handler(newRequestCtx("GET", "/static/app.js"))
+	s.handler.Handler(newRequestCtx("GET", "/static/css/app.css"))
+	s.handler.Handler(newRequestCtx("GET", "/static/"))
+
+	leaf := s.handler.routes()["GET"].getLeaf("/static/app.js")
 	s.Equal(
-		1,
-		s.obs.FilterMessage("can't find tree").
-			FilterField(zap.ByteString("http_method", []byte("GET"))).
-			Len(),
+		"Desc{fqName: \"test_service_static_filepath_all_requests_total\", "+
+			"help: \"Total requests to routes named static_filepath_all\", "+
+			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
+		leaf.metrics[metricTypeTotal].Desc().String(),
 	)
+	s.Equal(float64(3), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	s.Equal(0, s.obs.Len())
 }
 
-func (s *handlerSuite) TestLibHandlerFindLeafErr() {
-	s.handler.putMethod("/some-path-for-leaf-err", "GET")
+func (s *handlerSuite) TestHandlerUnmatched() {
+	s.handler.GET("/ping", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.POST("/user/:id", func(ctx *fasthttp.RequestCtx) {})
+
+	s.handler.Handler(newRequestCtx("GET", "/wp-admin"))
+	s.handler.Handler(newRequestCtx("GET", "/.env"))
+	s.handler.Handler(newRequestCtx("POST", "/ping"))
+	s.handler.Handler(newRequestCtx("DELETE", "/user/1"))
+	s.handler.Handler(newRequestCtx("PROPFIND", "/ping"))
+	s.handler.Handler(newRequestCtx("PROPFIND", "/nope"))
+	// matched request isn't counted
+	s.handler.Handler(newRequestCtx("GET", "/ping"))
+
+	s.Equal(5, testutil.CollectAndCount(s.handler.unmatched))
+	s.Equal(float64(2), testutil.ToFloat64(s.handler.unmatched.WithLabelValues("GET", reasonNotFound)))
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.unmatched.WithLabelValues("POST", reasonMethodNotAllowed)))
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.unmatched.WithLabelValues("DELETE", reasonMethodNotAllowed)))
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.unmatched.WithLabelValues(otherMethod, reasonMethodNotAllowed)))
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.unmatched.WithLabelValues(otherMethod, reasonNotFound)))
+	s.Equal(0, s.obs.Len())
+}
 
-	header := fasthttp.RequestHeader{}
-	header.SetMethod("GET")
+func (s *handlerSuite) TestNewMiddleware() {
+	m := NewMiddleware("test_service", zap.NewNop(), WithRegisterer(prometheus.NewRegistry()))
+	m.Declare("GET", "/user/:id")
+	next := m.Middleware(func(ctx *fasthttp.RequestCtx) {})
+	next(newRequestCtx("GET", "/user/1"))
+
+	leaf := m.handler.routes()["GET"].getLeaf("/user/1")
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	s.NoError(m.Validate())
+	s.NotNil(m.MetricsHandler())
+	s.True(m.Remove("GET", "/user/:id"))
+}
 
-	uri := &fasthttp.URI{}
-	uri.SetPath("/find-leaf")
+func (s *handlerSuite) TestNewRouterHandlerNilRouter() {
+	s.PanicsWithValue(
+		"fasthttp-prometheus: router must not be nil, use NewMiddleware to instrument handlers without router",
+		func() {
+			NewRouterHandler(nil, "test_service", zap.NewNop(), WithRegisterer(prometheus.NewRegistry()))
+		},
+	)
+}
 
-	req := fasthttp.Request{}
-	req.SetURI(uri)
-	req.Header = header
-	s.handler.libHandler(&fasthttp.RequestCtx{
-		Request: req,
+func (s *handlerSuite) TestMiddlewareDeclare() {
+	s.handler = NewMiddleware("test_service", zap.NewNop(), WithRegisterer(prometheus.NewRegistry())).handler
+	s.handler.Declare("GET", "/user/:id")
+	s.handler.Declare("GET", "/health", WithoutRouteInstrumentation())
+
+	next := s.handler.Middleware(func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) == "/none" {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+		}
 	})
+	next(newRequestCtx("GET", "/user/1"))
+	next(newRequestCtx("GET", "/user/2"))
+	next(newRequestCtx("GET", "/health"))
+	next(newRequestCtx("GET", "/none"))
 
-	s.Equal(0, s.obs.FilterMessage("can't find metric").Len())
+	leaf := s.handler.routes()["GET"].getLeaf("/user/1")
+	s.Equal(
+		"Desc{fqName: \"test_service_user_id_var_requests_total\", "+
+			"help: \"Total requests to routes named user_id_var\", "+
+			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
+		leaf.metrics[metricTypeTotal].Desc().String(),
+	)
+	s.Equal(float64(2), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.unmatched.WithLabelValues("GET", reasonNotFound)))
+	s.Equal(float64(0), testutil.ToFloat64(s.handler.inFlight))
 }
 
-func (s *handlerSuite) TestLibHandlerIncTotalMetricErr() {
-	s.handler.putMethod("/some-path-for-total-metric-err", "GET")
-	leaf := s.handler.trie["GET"].getLeaf("/some-path-for-total-metric-err")
-	delete(leaf.metrics, metricTypeTotal)
+func (s *handlerSuite) TestMiddlewareRouteResolver() {
+	s.handler = NewMiddleware(
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(prometheus.NewRegistry()),
+		WithLabeledMetrics(),
+		WithRouteResolver(func(ctx *fasthttp.RequestCtx) string {
+			route, _ := ctx.UserValue("route").(string)
+			return route
+		}),
+	).handler
+	s.handler.Declare("GET", "/user/{id}")
+	s.handler.Declare("GET", "/static/{filepath:*}")
+
+	next := s.handler.Middleware(func(ctx *fasthttp.RequestCtx) {
+		if ctx.UserValue("route") == nil {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+		}
+	})
+
+	// route is set by outer middleware before instrumented handler is called
+	ctx := newRequestCtx("GET", "/user/1")
+	ctx.SetUserValue("route", "/user/{id}")
+	next(ctx)
+	ctx = newRequestCtx("GET", "/static/app.js")
+	ctx.SetUserValue("route", "/static/{filepath:*}")
+	next(ctx)
+	next(newRequestCtx("GET", "/none"))
+
+	total := s.handler.vecs[metricTypeTotal]
+	s.Equal(float64(1), testutil.ToFloat64(total.WithLabelValues("/user/{id}", "GET", "200")))
+	s.Equal(float64(1), testutil.ToFloat64(total.WithLabelValues("/static/{filepath:*}", "GET", "200")))
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.unmatched.WithLabelValues("GET", reasonNotFound)))
+}
+
+func (s *handlerSuite) TestMiddlewareMetricsHandler() {
+	s.handler = NewMiddleware("test_service", zap.NewNop(), WithRegisterer(prometheus.NewRegistry())).handler
+	next := s.handler.Middleware(s.handler.MetricsHandler())
+
+	ctx := newRequestCtx("GET", "/metrics")
+	next(ctx)
+
+	s.Equal(fasthttp.StatusOK, ctx.Response.StatusCode())
+	// scrape isn't in flight like request to metrics endpoint of router dispatched by Handler
+	s.Contains(string(ctx.Response.Body()), "test_service_in_flight_requests 0")
+	s.Equal(0, testutil.CollectAndCount(s.handler.unmatched))
+	s.Equal(float64(0), testutil.ToFloat64(s.handler.inFlight))
+}
+
+func (s *handlerSuite) TestHandlerInFlightWithoutInstrumentation() {
+	s.handler.ServeMetrics("/metrics")
+	var inFlight float64
+	s.handler.GET("/health", func(ctx *fasthttp.RequestCtx) {
+		inFlight = testutil.ToFloat64(s.handler.inFlight)
+	}, WithoutRouteInstrumentation())
+	s.handler.GET("/ping", func(ctx *fasthttp.RequestCtx) {
+		inFlight = testutil.ToFloat64(s.handler.inFlight)
+	})
+
+	s.handler.Handler(newRequestCtx("GET", "/health"))
+	s.Equal(float64(0), inFlight)
+
+	s.handler.Handler(newRequestCtx("GET", "/ping"))
+	s.Equal(float64(1), inFlight)
+
+	ctx := newRequestCtx("GET", "/metrics")
+	s.handler.Handler(ctx)
+	s.Contains(string(ctx.Response.Body()), "test_service_in_flight_requests 0")
+	s.Equal(float64(0), testutil.ToFloat64(s.handler.inFlight))
+}
+
+// lockedRouter serializes registration of routes in router with serving requests,
+// so routes are registered at runtime like by router supporting it
+type lockedRouter struct {
+	Router
+
+	mu sync.RWMutex
+}
+
+func (r *lockedRouter) Handle(method, path string, handle fasthttp.RequestHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Router.Handle(method, path, handle)
+}
+
+func (r *lockedRouter) Handler(ctx *fasthttp.RequestCtx) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	r.Router.Handler(ctx)
+}
+
+func (s *handlerSuite) TestConcurrentHandleAndHandler() {
+	s.handler = NewRouterHandler(
+		&lockedRouter{Router: NewFasthttprouterAdapter(fasthttprouter.New())},
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(prometheus.NewRegistry()),
+	)
+	s.handler.GET("/ping", func(ctx *fasthttp.RequestCtx) {})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			s.handler.GET(fmt.Sprintf("/feature-%d/:id", i), func(ctx *fasthttp.RequestCtx) {})
+			s.handler.POST(fmt.Sprintf("/feature-%d/:id", i), func(ctx *fasthttp.RequestCtx) {})
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				s.handler.Handler(newRequestCtx("GET", "/ping"))
+				s.handler.Handler(newRequestCtx("GET", fmt.Sprintf("/feature-%d/1", i)))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s.handler.Handler(newRequestCtx("GET", "/feature-1/1"))
+	leaf := s.handler.routes()["GET"].getLeaf("/ping")
+	s.Equal(float64(100), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	leaf = s.handler.routes()["GET"].getLeaf("/feature-1/1")
+	s.GreaterOrEqual(testutil.ToFloat64(leaf.metrics[metricTypeTotal]), float64(1))
+	for i := 0; i < 10; i++ {
+		s.NotNil(s.handler.routes()["GET"].getLeaf(fmt.Sprintf("/feature-%d/1", i)))
+		s.NotNil(s.handler.routes()["POST"].getLeaf(fmt.Sprintf("/feature-%d/1", i)))
+	}
+	s.Equal(float64(0), testutil.ToFloat64(s.handler.inFlight))
+}
+
+func (s *handlerSuite) TestConcurrentDeclareAndMiddleware() {
+	s.handler = NewMiddleware("test_service", zap.NewNop(), WithRegisterer(prometheus.NewRegistry())).handler
+	next := s.handler.Middleware(func(ctx *fasthttp.RequestCtx) {})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			s.handler.Declare("GET", fmt.Sprintf("/plugin-%d/*page", i))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				next(newRequestCtx("GET", fmt.Sprintf("/plugin-%d/index", i)))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	next(newRequestCtx("GET", "/plugin-0/index"))
+	leaf := s.handler.routes()["GET"].getLeaf("/plugin-0/index")
+	s.GreaterOrEqual(testutil.ToFloat64(leaf.metrics[metricTypeTotal]), float64(1))
+	s.Equal(float64(0), testutil.ToFloat64(s.handler.inFlight))
+}
+
+func (s *handlerSuite) TestRemove() {
+	registry := prometheus.NewRegistry()
+	s.handler = NewHandler(fasthttprouter.New(), "test_service", zap.NewNop(), WithRegisterer(registry))
+	s.handler.GET("/user/:id", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.GET("/user/:id/orders", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.POST("/ping", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.Handler(newRequestCtx("GET", "/user/1"))
+
+	s.True(s.handler.Remove("GET", "/user/:id"))
+	s.False(s.handler.Remove("GET", "/user/:id"))
+	s.False(s.handler.Remove("PUT", "/user/:id"))
+
+	s.Nil(s.handler.routes()["GET"].getLeaf("/user/1"))
+	s.NotNil(s.handler.routes()["GET"].getLeaf("/user/1/orders"))
+	families, err := registry.Gather()
+	s.Nil(err)
+	for _, family := range families {
+		s.NotContains(family.GetName(), "test_service_user_id_var_requests")
+	}
+
+	s.True(s.handler.Remove("POST", "/ping"))
+	s.NotContains(s.handler.routes(), "POST")
+
+	// route is registered again with new metrics
+	s.handler.putMethod("/user/:id", "GET")
+	s.handler.Handler(newRequestCtx("GET", "/user/1"))
+	leaf := s.handler.routes()["GET"].getLeaf("/user/1")
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+}
+
+func (s *handlerSuite) TestRemoveOptionalParams() {
+	s.handler = NewRouterHandler(
+		NewFasthttpRouterAdapter(fastrouter.New()),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(prometheus.NewRegistry()),
+	)
+	s.handler.GET("/user/{name?}", func(ctx *fasthttp.RequestCtx) {})
+
+	s.True(s.handler.Remove("GET", "/user/{name?}"))
+	s.NotContains(s.handler.routes(), "GET")
+}
+
+func (s *handlerSuite) TestRemoveLabeled() {
+	s.handler = NewMiddleware("test_service", zap.NewNop(), WithRegisterer(prometheus.NewRegistry()), WithLabeledMetrics()).handler
+	s.handler.Declare("GET", "/user/:id")
+	s.handler.Declare("GET", "/ping")
+	next := s.handler.Middleware(func(ctx *fasthttp.RequestCtx) {})
+	next(newRequestCtx("GET", "/user/1"))
+	next(newRequestCtx("GET", "/ping"))
+
+	s.True(s.handler.Remove("GET", "/user/:id"))
+
+	s.Equal(1, testutil.CollectAndCount(s.handler.vecs[metricTypeTotal]))
+	s.Equal(1, testutil.CollectAndCount(s.handler.histogramVecs[metricTypeDuration]))
+	s.Equal(1, testutil.CollectAndCount(s.handler.gaugeVecs[metricTypeInFlight]))
+	s.Equal(
+		float64(1),
+		testutil.ToFloat64(s.handler.vecs[metricTypeTotal].WithLabelValues("/ping", "GET", "200")),
+	)
+}
+
+func (s *handlerSuite) TestHandlerRedirect() {
+	s.handler.GET("/ping", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.POST("/user/:id", func(ctx *fasthttp.RequestCtx) {})
+
+	for _, path := range []string{"/ping/", "/PING", "/ping"} {
+		s.handler.Handler(newRequestCtx("GET", path))
+	}
+	// fasthttp normalizes path before routing
+	s.handler.Handler(newRequestCtx("GET", "//ping"))
+	ctx := newRequestCtx("POST", "/user/1/")
+	s.handler.Handler(ctx)
+
+	s.Equal(fasthttp.StatusTemporaryRedirect, ctx.Response.StatusCode())
+	leaf := s.handler.routes()["GET"].getLeaf("/ping")
+	s.Equal(
+		"Desc{fqName: \"test_service_ping_requests_redirect_total\", "+
+			"help: \"Requests redirected by router to routes named ping\", "+
+			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
+		leaf.metrics[metricTypeRedirect].Desc().String(),
+	)
+	s.Equal(float64(2), testutil.ToFloat64(leaf.metrics[metricTypeRedirect]))
+	s.Equal(float64(2), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	leaf = s.handler.routes()["POST"].getLeaf("/user/1")
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeRedirect]))
+	s.Equal(float64(0), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	s.Equal(0, testutil.CollectAndCount(s.handler.unmatched))
+}
 
-	header := fasthttp.RequestHeader{}
-	header.SetMethod("GET")
+func (s *handlerSuite) TestMiddlewareRedirect() {
+	s.handler = NewMiddleware(
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(prometheus.NewRegistry()),
+		WithLabeledMetrics(),
+	).handler
+	s.handler.Declare("GET", "/user/:id/orders")
+	next := s.handler.Middleware(func(ctx *fasthttp.RequestCtx) {
+		switch string(ctx.Path()) {
+		case "/USER/1/Orders/":
+			ctx.Redirect("/user/1/orders", fasthttp.StatusMovedPermanently)
+		case "/user/1/orders/":
+			ctx.Redirect("/user/1/orders", fasthttp.StatusFound)
+		case "/user/2":
+			ctx.Redirect("/user/2/orders", fasthttp.StatusMovedPermanently)
+		default:
+			ctx.SetStatusCode(fasthttp.StatusMovedPermanently)
+		}
+	})
 
-	uri := &fasthttp.URI{}
-	uri.SetPath("/some-path-for-total-metric-err")
+	next(newRequestCtx("GET", "/USER/1/Orders/"))
+	// status code isn't one of router redirect
+	next(newRequestCtx("GET", "/user/1/orders/"))
+	// location isn't fixed path
+	next(newRequestCtx("GET", "/user/2"))
+	// no location
+	next(newRequestCtx("GET", "/user/3/orders/"))
 
-	req := fasthttp.Request{}
-	req.SetURI(uri)
-	req.Header = header
-	s.handler.libHandler(&fasthttp.RequestCtx{
-		Request: req,
+	s.Equal(1, testutil.CollectAndCount(s.handler.vecs[metricTypeRedirect]))
+	s.Equal(
+		float64(1),
+		testutil.ToFloat64(s.handler.vecs[metricTypeRedirect].WithLabelValues("/user/:id/orders", "GET", "301")),
+	)
+	s.Equal(0, testutil.CollectAndCount(s.handler.vecs[metricTypeTotal]))
+}
+
+func (s *handlerSuite) TestNotFoundRedirect() {
+	router := fasthttprouter.New()
+	router.RedirectTrailingSlash = false
+	s.handler = NewHandler(router, "test_service", zap.NewNop(), WithRegisterer(prometheus.NewRegistry()))
+	s.handler.GET("/ping", func(ctx *fasthttp.RequestCtx) {})
+	// NotFound handler redirects like router does
+	s.handler.NotFound(func(ctx *fasthttp.RequestCtx) {
+		ctx.Redirect("/ping", fasthttp.StatusMovedPermanently)
 	})
 
+	ctx := newRequestCtx("GET", "/ping/")
+	s.handler.Handler(ctx)
+
+	s.Equal(fasthttp.StatusMovedPermanently, ctx.Response.StatusCode())
+	leaf := s.handler.routes()["GET"].getLeaf("/ping")
+	s.Equal(float64(0), testutil.ToFloat64(leaf.metrics[metricTypeRedirect]))
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.unmatched.WithLabelValues("GET", reasonNotFound)))
+}
+
+func (s *handlerSuite) TestMethodLabel() {
+	s.handler.putMethod("/ping", "PROPFIND")
+
+	s.Equal("GET", s.handler.methodLabel([]byte("GET")))
+	s.Equal("TRACE", s.handler.methodLabel([]byte("TRACE")))
+	s.Equal("PROPFIND", s.handler.methodLabel([]byte("PROPFIND")))
+	s.Equal(otherMethod, s.handler.methodLabel([]byte("MKCOL")))
+}
+
+func (s *handlerSuite) TestCollectIncTotalMetricErr() {
+	s.handler.putMethod("/some-path-for-total-metric-err", "GET")
+	leaf := s.handler.routes()["GET"].getLeaf("/some-path-for-total-metric-err")
+	delete(leaf.metrics, metricTypeTotal)
+
+	ctx := newRequestCtx("GET", "/some-path-for-total-metric-err")
+	s.handler.collect(ctx, s.handler.getLeaf(ctx), time.Millisecond)
+
 	s.Equal(
 		1,
 		s.obs.FilterMessage("can't find metric").
@@ -635,28 +1821,14 @@ func (s *handlerSuite) TestLibHandlerIncTotalMetricErr() {
 	)
 }
 
-func (s *handlerSuite) TestLibHandlerIncFailureMetricErr() {
+func (s *handlerSuite) TestCollectIncFailureMetricErr() {
 	s.handler.putMethod("/some-path-for-failure-metric-err", "GET")
-	leaf := s.handler.trie["GET"].getLeaf("/some-path-for-failure-metric-err")
+	leaf := s.handler.routes()["GET"].getLeaf("/some-path-for-failure-metric-err")
 	delete(leaf.metrics, metricTypeFailure)
 
-	header := fasthttp.RequestHeader{}
-	header.SetMethod("GET")
-
-	uri := &fasthttp.URI{}
-	uri.SetPath("/some-path-for-failure-metric-err")
-
-	req := fasthttp.Request{}
-	req.SetURI(uri)
-	req.Header = header
-
-	resp := fasthttp.Response{}
-	resp.SetStatusCode(fasthttp.StatusInternalServerError)
-
-	s.handler.libHandler(&fasthttp.RequestCtx{
-		Request:  req,
-		Response: resp,
-	})
+	ctx := newRequestCtx("GET", "/some-path-for-failure-metric-err")
+	ctx.Response.SetStatusCode(fasthttp.StatusInternalServerError)
+	s.handler.collect(ctx, s.handler.getLeaf(ctx), time.Millisecond)
 
 	s.Equal(
 		1,
@@ -668,22 +1840,268 @@ func (s *handlerSuite) TestLibHandlerIncFailureMetricErr() {
 	)
 }
 
-func (s *handlerSuite) TestLibHandlerOk() {
+func (s *handlerSuite) TestCollectOk() {
 	s.handler.putMethod("/some-path-for-metric-ok", "GET")
 
-	header := fasthttp.RequestHeader{}
-	header.SetMethod("GET")
+	ctx := newRequestCtx("GET", "/some-path-for-metric-ok")
+	s.handler.collect(ctx, s.handler.getLeaf(ctx), time.Millisecond)
+
+	s.Equal(0, s.obs.FilterMessage("can't find metric").Len())
+}
 
-	uri := &fasthttp.URI{}
-	uri.SetPath("/some-path-for-metric-ok")
+func (s *handlerSuite) TestCollectObserveDurationMetricErr() {
+	s.handler.putMethod("/some-path-for-duration-metric-err", "GET")
+	leaf := s.handler.routes()["GET"].getLeaf("/some-path-for-duration-metric-err")
+	delete(leaf.histograms, metricTypeDuration)
 
-	req := fasthttp.Request{}
-	req.SetURI(uri)
-	req.Header = header
+	ctx := newRequestCtx("GET", "/some-path-for-duration-metric-err")
+	s.handler.collect(ctx, s.handler.getLeaf(ctx), time.Millisecond)
 
-	s.handler.libHandler(&fasthttp.RequestCtx{
-		Request: req,
+	s.Equal(
+		1,
+		s.obs.FilterMessage("can't find metric").
+			FilterField(zap.ByteString("path", []byte("/some-path-for-duration-metric-err"))).
+			FilterField(zap.ByteString("http_method", []byte("GET"))).
+			FilterField(zap.String("metric_type", metricTypeDuration)).
+			Len(),
+	)
+}
+
+func (s *handlerSuite) TestCollectObserveDuration() {
+	s.handler.putMethod("/some-path-for-duration", "GET")
+
+	ctx := newRequestCtx("GET", "/some-path-for-duration")
+	s.handler.collect(ctx, s.handler.getLeaf(ctx), 250*time.Millisecond)
+
+	metric := &dto.Metric{}
+	leaf := s.handler.routes()["GET"].getLeaf("/some-path-for-duration")
+	s.Nil(leaf.histograms[metricTypeDuration].Write(metric))
+	s.Equal(uint64(1), metric.GetHistogram().GetSampleCount())
+	s.Equal(0.25, metric.GetHistogram().GetSampleSum())
+}
+
+func (s *handlerSuite) TestLabeledMetrics() {
+	var core zapcore.Core
+	core, s.obs = observer.New(zap.InfoLevel)
+	s.handler = NewHandler(
+		fasthttprouter.New(),
+		"labeled_service",
+		zap.New(core),
+		WithRegisterer(prometheus.NewRegistry()),
+		WithLabeledMetrics(),
+	)
+	s.handler.GET("/user/:id", func(ctx *fasthttp.RequestCtx) {
+		if ctx.UserValue("id") == "2" {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			return
+		}
+		ctx.SetStatusCode(fasthttp.StatusOK)
+	})
+	s.handler.POST("/user/:id", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusOK)
 	})
 
+	s.Equal(
+		"Desc{fqName: \"labeled_service_http_requests_total\", "+
+			"help: \"Total HTTP requests by route, method and status\", "+
+			"constLabels: {}, variableLabels: [{route <nil>} {method <nil>} {status <nil>}]}",
+		(<-s.describe(s.handler.vecs[metricTypeTotal])).String(),
+	)
+
+	s.handler.Handler(newRequestCtx("GET", "/user/1"))
+	s.handler.Handler(newRequestCtx("GET", "/user/1"))
+	s.handler.Handler(newRequestCtx("GET", "/user/2"))
+	s.handler.Handler(newRequestCtx("POST", "/user/1"))
+
+	total := s.handler.vecs[metricTypeTotal]
+	failure := s.handler.vecs[metricTypeFailure]
+	s.Equal(float64(2), testutil.ToFloat64(total.WithLabelValues("/user/:id", "GET", "200")))
+	s.Equal(float64(1), testutil.ToFloat64(total.WithLabelValues("/user/:id", "GET", "500")))
+	s.Equal(float64(1), testutil.ToFloat64(total.WithLabelValues("/user/:id", "POST", "200")))
+	s.Equal(float64(1), testutil.ToFloat64(failure.WithLabelValues("/user/:id", "GET", "500")))
+	s.Equal(1, testutil.CollectAndCount(failure))
+	s.Equal(2, testutil.CollectAndCount(s.handler.histogramVecs[metricTypeDuration]))
+	s.Equal(2, testutil.CollectAndCount(s.handler.histogramVecs[metricTypeRequestSize]))
+	s.Equal(2, testutil.CollectAndCount(s.handler.histogramVecs[metricTypeResponseSize]))
+	s.Equal(2, testutil.CollectAndCount(s.handler.gaugeVecs[metricTypeInFlight]))
 	s.Equal(0, s.obs.FilterMessage("can't find metric").Len())
+	s.Equal(0, s.obs.FilterMessage("can't register labeled metric").Len())
+}
+
+func (s *handlerSuite) describe(collector prometheus.Collector) <-chan *prometheus.Desc {
+	ch := make(chan *prometheus.Desc, 1)
+	collector.Describe(ch)
+
+	return ch
+}
+
+func (s *handlerSuite) TestIncVecNotFound() {
+	vecs := map[string]*prometheus.CounterVec{}
+	err := s.handler.incVec(vecs, metricTypeTotal, "200")
+
+	s.Equal(metricNotFoundErr, err)
+}
+
+func (s *handlerSuite) TestCollectIncStatus() {
+	s.handler.putMethod("/some-path-for-status", "GET")
+	leaf := s.handler.routes()["GET"].getLeaf("/some-path-for-status")
+	status, class := leaf.vecs[metricTypeStatus], leaf.vecs[metricTypeStatusClass]
+	s.Equal(0, testutil.CollectAndCount(status))
+	s.Equal(0, testutil.CollectAndCount(class))
+
+	for _, statusCode := range []int{fasthttp.StatusOK, fasthttp.StatusNotFound, fasthttp.StatusNotFound, fasthttp.StatusServiceUnavailable} {
+		ctx := newRequestCtx("GET", "/some-path-for-status")
+		ctx.Response.SetStatusCode(statusCode)
+		s.handler.collect(ctx, s.handler.getLeaf(ctx), time.Millisecond)
+	}
+
+	s.Equal(3, testutil.CollectAndCount(status))
+	s.Equal(float64(1), testutil.ToFloat64(status.WithLabelValues("200")))
+	s.Equal(float64(2), testutil.ToFloat64(status.WithLabelValues("404")))
+	s.Equal(float64(1), testutil.ToFloat64(status.WithLabelValues("503")))
+	s.Equal(3, testutil.CollectAndCount(class))
+	s.Equal(float64(1), testutil.ToFloat64(class.WithLabelValues("2xx")))
+	s.Equal(float64(2), testutil.ToFloat64(class.WithLabelValues("4xx")))
+	s.Equal(float64(1), testutil.ToFloat64(class.WithLabelValues("5xx")))
+	s.Equal(0, s.obs.FilterMessage("can't find metric").Len())
+}
+
+func (s *handlerSuite) TestCollectIncStatusMetricErr() {
+	s.handler.putMethod("/some-path-for-status-metric-err", "GET")
+	leaf := s.handler.routes()["GET"].getLeaf("/some-path-for-status-metric-err")
+	delete(leaf.vecs, metricTypeStatusClass)
+
+	ctx := newRequestCtx("GET", "/some-path-for-status-metric-err")
+	s.handler.collect(ctx, s.handler.getLeaf(ctx), time.Millisecond)
+
+	s.Equal(1, s.obs.FilterMessage("can't find metric").Len())
+	s.Equal(
+		1,
+		s.obs.FilterMessage("can't find metric").
+			FilterField(zap.String("metric_type", metricTypeStatusClass)).
+			Len(),
+	)
+}
+
+func TestStatusClass(t *testing.T) {
+	assert.Equal(t, "1xx", statusClass(fasthttp.StatusContinue))
+	assert.Equal(t, "2xx", statusClass(fasthttp.StatusNoContent))
+	assert.Equal(t, "3xx", statusClass(fasthttp.StatusMovedPermanently))
+	assert.Equal(t, "4xx", statusClass(fasthttp.StatusNotFound))
+	assert.Equal(t, "5xx", statusClass(fasthttp.StatusServiceUnavailable))
+}
+
+func (s *handlerSuite) TestCollectFailureClassifier() {
+	s.handler = NewHandler(
+		fasthttprouter.New(),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(prometheus.NewRegistry()),
+		WithFailureClassifier(func(ctx *fasthttp.RequestCtx) bool {
+			return ctx.Response.StatusCode() >= fasthttp.StatusInternalServerError
+		}),
+	)
+	s.handler.GET("/some-path-for-classifier", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.GET(
+		"/some-path-for-route-classifier",
+		func(ctx *fasthttp.RequestCtx) {},
+		WithRouteFailureClassifier(func(ctx *fasthttp.RequestCtx) bool {
+			return string(ctx.Response.Body()) == "error"
+		}),
+	)
+
+	for _, statusCode := range []int{fasthttp.StatusOK, fasthttp.StatusNotFound, fasthttp.StatusBadGateway} {
+		ctx := newRequestCtx("GET", "/some-path-for-classifier")
+		ctx.Response.SetStatusCode(statusCode)
+		s.handler.collect(ctx, s.handler.getLeaf(ctx), time.Millisecond)
+	}
+	leaf := s.handler.routes()["GET"].getLeaf("/some-path-for-classifier")
+	s.Nil(leaf.isFailure)
+	s.Equal(float64(3), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeFailure]))
+
+	for _, body := range []string{"OK", "error", "error"} {
+		ctx := newRequestCtx("GET", "/some-path-for-route-classifier")
+		ctx.Response.SetStatusCode(fasthttp.StatusOK)
+		ctx.Response.SetBodyString(body)
+		s.handler.collect(ctx, s.handler.getLeaf(ctx), time.Millisecond)
+	}
+	leaf = s.handler.routes()["GET"].getLeaf("/some-path-for-route-classifier")
+	s.NotNil(leaf.isFailure)
+	s.Equal(float64(3), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	s.Equal(float64(2), testutil.ToFloat64(leaf.metrics[metricTypeFailure]))
+}
+
+func TestDefaultFailureClassifier(t *testing.T) {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Response.SetStatusCode(fasthttp.StatusOK)
+	assert.False(t, defaultFailureClassifier(ctx))
+
+	ctx.Response.SetStatusCode(fasthttp.StatusNotFound)
+	assert.True(t, defaultFailureClassifier(ctx))
+
+	ctx.Response.SetStatusCode(fasthttp.StatusInternalServerError)
+	assert.True(t, defaultFailureClassifier(ctx))
+}
+
+func (s *handlerSuite) TestCollectObserveSizes() {
+	s.handler = NewHandler(
+		fasthttprouter.New(),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(prometheus.NewRegistry()),
+		WithSizeBuckets([]float64{10, 100}),
+	)
+	s.handler.putMethod("/some-path-for-sizes", "POST")
+
+	ctx := newRequestCtx("POST", "/some-path-for-sizes")
+	ctx.Request.SetBodyString("request body")
+	ctx.Response.SetBodyString("response")
+	s.handler.collect(ctx, s.handler.getLeaf(ctx), time.Millisecond)
+
+	leaf := s.handler.routes()["POST"].getLeaf("/some-path-for-sizes")
+	metric := &dto.Metric{}
+	s.Nil(leaf.histograms[metricTypeRequestSize].Write(metric))
+	s.Equal(float64(12), metric.GetHistogram().GetSampleSum())
+	s.Len(metric.GetHistogram().GetBucket(), 2)
+	s.Equal(uint64(0), metric.GetHistogram().GetBucket()[0].GetCumulativeCount())
+
+	metric = &dto.Metric{}
+	s.Nil(leaf.histograms[metricTypeResponseSize].Write(metric))
+	s.Equal(float64(8), metric.GetHistogram().GetSampleSum())
+	s.Equal(uint64(1), metric.GetHistogram().GetBucket()[0].GetCumulativeCount())
+}
+
+func (s *handlerSuite) TestCollectObserveSizeMetricErr() {
+	s.handler.putMethod("/some-path-for-size-metric-err", "GET")
+	leaf := s.handler.routes()["GET"].getLeaf("/some-path-for-size-metric-err")
+	delete(leaf.histograms, metricTypeResponseSize)
+
+	ctx := newRequestCtx("GET", "/some-path-for-size-metric-err")
+	s.handler.collect(ctx, s.handler.getLeaf(ctx), time.Millisecond)
+
+	s.Equal(1, s.obs.FilterMessage("can't find metric").Len())
+	s.Equal(
+		1,
+		s.obs.FilterMessage("can't find metric").
+			FilterField(zap.String("metric_type", metricTypeResponseSize)).
+			Len(),
+	)
+}
+
+func TestRequestSize(t *testing.T) {
+	ctx := &fasthttp.RequestCtx{}
+	assert.Equal(t, 0, requestSize(ctx))
+
+	ctx.Request.SetBodyString("body")
+	assert.Equal(t, 4, requestSize(ctx))
+
+	// chunked body
+	ctx.Request.Header.SetContentLength(-1)
+	assert.Equal(t, 4, requestSize(ctx))
+
+	// streamed body is not read yet, size is taken from header
+	ctx.Request.ResetBody()
+	ctx.Request.Header.SetContentLength(1024)
+	assert.Equal(t, 1024, requestSize(ctx))
 }
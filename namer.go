@@ -0,0 +1,96 @@
+package fasthttpprometheus
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricKind is kind of per route metric passed to MetricNamer
+type MetricKind string
+
+const (
+	// MetricTotal is counter of requests
+	MetricTotal = MetricKind(metricTypeTotal)
+	// MetricFailure is counter of failed requests
+	MetricFailure = MetricKind(metricTypeFailure)
+	// MetricRedirect is counter of requests redirected by router to the route
+	MetricRedirect = MetricKind(metricTypeRedirect)
+	// MetricPanics is counter of panics of route handler
+	MetricPanics = MetricKind(metricTypePanics)
+	// MetricStatus is counter of requests labeled by status code
+	MetricStatus = MetricKind(metricTypeStatus)
+	// MetricStatusClass is counter of requests labeled by status class
+	MetricStatusClass = MetricKind(metricTypeStatusClass)
+	// MetricDuration is histogram of request duration in seconds
+	MetricDuration = MetricKind(metricTypeDuration)
+	// MetricRequestSize is histogram of request size in bytes
+	MetricRequestSize = MetricKind(metricTypeRequestSize)
+	// MetricResponseSize is histogram of response size in bytes
+	MetricResponseSize = MetricKind(metricTypeResponseSize)
+	// MetricInFlight is gauge of requests being handled
+	MetricInFlight = MetricKind(metricTypeInFlight)
+)
+
+// defaultHelps are formats of help texts of default metric namer by route part of metric name, e.g. user_id_var.
+// They mention neither http method nor route template because metrics with the same name share help text:
+// metrics of all http methods of route and, e.g. with CollisionLabel strategy or after Remove,
+// metrics of templates with the same name, e.g. /user-info and /user_info
+var defaultHelps = map[MetricKind]string{
+	MetricTotal:        "Total requests to routes named %s",
+	MetricFailure:      "Failed requests to routes named %s",
+	MetricRedirect:     "Requests redirected by router to routes named %s",
+	MetricPanics:       "Panics of handlers of routes named %s",
+	MetricStatus:       "Requests to routes named %s by status code",
+	MetricStatusClass:  "Requests to routes named %s by status class",
+	MetricDuration:     "Duration of requests to routes named %s in seconds",
+	MetricRequestSize:  "Size of requests to routes named %s in bytes",
+	MetricResponseSize: "Size of responses to requests to routes named %s in bytes",
+	MetricInFlight:     "Requests to routes named %s being handled",
+}
+
+// MetricNamer names per route metrics, see WithMetricNamer
+type MetricNamer interface {
+	// MetricName returns fully-qualified name, help text and const labels of metric of given kind
+	// of route with http method and template, e.g. GET and /user/:id
+	MetricName(httpMethod, route string, kind MetricKind) (name, help string, labels prometheus.Labels)
+}
+
+// defaultMetricNamer names metrics {namespace}_{subsystem}_{route}_requests_{kind}, labels them by http_method
+// and describes them by route part of the name, e.g. "Total requests to routes named user_id_var"
+type defaultMetricNamer struct {
+	namespace string
+	subsystem string
+}
+
+// NewDefaultMetricNamer returns MetricNamer used by default, e.g. it names counter of requests to GET /user/:id
+// {namespace}_{subsystem}_user_id_var_requests_total labeled by http_method="GET".
+// Custom namer may fall back to it for some routes
+func NewDefaultMetricNamer(namespace, subsystem string) MetricNamer {
+	return &defaultMetricNamer{
+		namespace: namespace,
+		subsystem: subsystem,
+	}
+}
+
+func (n *defaultMetricNamer) MetricName(
+	httpMethod, route string,
+	kind MetricKind,
+) (string, string, prometheus.Labels) {
+	routeName := routeMetricName(route)
+	name := prometheus.BuildFQName(n.namespace, n.subsystem, routeName+"_"+requests+"_"+string(kind))
+
+	help := fmt.Sprintf(defaultHelps[kind], routeName)
+
+	return name, help, prometheus.Labels{"http_method": httpMethod}
+}
+
+// routeMetricName returns part of metric name made of route template like trie does, e.g. user_id_var of /user/:id
+func routeMetricName(route string) string {
+	paths := optionalPaths(route)
+
+	var metricName string
+	new(node).addPath(normalizePath(paths[len(paths)-1]), &metricName)
+
+	return metricName
+}
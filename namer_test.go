@@ -0,0 +1,85 @@
+package fasthttpprometheus
+
+import (
+	"testing"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// httpServerNamer names metrics by OpenTelemetry-like conventions labeled by route
+type httpServerNamer struct{}
+
+func (httpServerNamer) MetricName(httpMethod, route string, kind MetricKind) (string, string, prometheus.Labels) {
+	return "http_server_" + string(kind), "HTTP server " + string(kind), prometheus.Labels{
+		"http_route":  route,
+		"http_method": httpMethod,
+	}
+}
+
+func TestDefaultMetricNamer(t *testing.T) {
+	namer := NewDefaultMetricNamer("service", "")
+
+	name, help, labels := namer.MetricName("GET", "/user/:id/some-method", MetricTotal)
+	assert.Equal(t, "service_user_id_var_some_method_requests_total", name)
+	assert.Equal(t, "Total requests to routes named user_id_var_some_method", help)
+	assert.Equal(t, prometheus.Labels{"http_method": "GET"}, labels)
+
+	name, _, _ = NewDefaultMetricNamer("service", "api").MetricName("POST", "/", MetricDuration)
+	assert.Equal(t, "service_api_root_requests_duration_seconds", name)
+}
+
+func TestRouteMetricName(t *testing.T) {
+	assert.Equal(t, "user_id_var", routeMetricName("/user/:id"))
+	assert.Equal(t, "user_id_var", routeMetricName("/user/{id:[0-9]+}"))
+	assert.Equal(t, "article_slug_var", routeMetricName("/article/{slug?}"))
+	assert.Equal(t, "static_filepath_all", routeMetricName("/static/*filepath"))
+	assert.Equal(t, "api_hello", routeMetricName("/api/hello/"))
+	assert.Equal(t, "root", routeMetricName("/"))
+}
+
+func TestInsertHash(t *testing.T) {
+	assert.Equal(t, "service_a_requests_0a1b2c3d_total", insertHash("service_a_requests_total", "total", "0a1b2c3d"))
+	assert.Equal(
+		t,
+		"service_a_requests_0a1b2c3d_failure_total",
+		insertHash("service_a_requests_failure_total", "failure_total", "0a1b2c3d"),
+	)
+	assert.Equal(t, "http_requests_0a1b2c3d", insertHash("http_requests", "total", "0a1b2c3d"))
+}
+
+func TestWithMetricNamer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	h := NewHandler(
+		fasthttprouter.New(),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(registry),
+		WithMetricNamer(httpServerNamer{}),
+		WithConstLabels(prometheus.Labels{"env": "test"}),
+	)
+	h.GET("/user/:id", func(ctx *fasthttp.RequestCtx) {})
+	h.GET("/ping", func(ctx *fasthttp.RequestCtx) {})
+	assert.NoError(t, h.Validate())
+
+	h.Handler(newRequestCtx("GET", "/user/1"))
+	h.Handler(newRequestCtx("GET", "/ping"))
+	h.Handler(newRequestCtx("GET", "/ping"))
+
+	leaf := h.routes()["GET"].getLeaf("/ping")
+	assert.Equal(
+		t,
+		"Desc{fqName: \"http_server_total\", help: \"HTTP server total\", "+
+			"constLabels: {env=\"test\",http_method=\"GET\",http_route=\"/ping\"}, variableLabels: []}",
+		leaf.metrics[metricTypeTotal].Desc().String(),
+	)
+	assert.Equal(t, float64(2), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	assert.Equal(t, 2, testutil.CollectAndCount(registry, "http_server_total"))
+	assert.Equal(t, 2, testutil.CollectAndCount(registry, "http_server_duration_seconds"))
+	// metric name is shared by routes distinguished by http_route label
+	assert.Equal(t, map[string]string{"http_server_total": "/user/:id"}, h.metricRoutes)
+}
@@ -0,0 +1,178 @@
+package fasthttpprometheus
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fasthttp"
+)
+
+// Option configures handler created by NewHandler
+type Option func(h *handler)
+
+// RouteOption configures single route registered by GET, POST and other methods
+type RouteOption func(o *routeOptions)
+
+// FailureClassifier decides if request is failed and failure counter must be incremented
+type FailureClassifier func(ctx *fasthttp.RequestCtx) bool
+
+// RouteResolver returns route template of request, e.g. /user/:id, or empty string if route is unknown
+type RouteResolver func(ctx *fasthttp.RequestCtx) string
+
+// CollisionStrategy decides how collision of metric names of routes is resolved,
+// e.g. /user-info and /user_info routes are both named user_info
+type CollisionStrategy int
+
+const (
+	// CollisionError fails registration of route which metric name is taken by another route,
+	// metrics of the route are disabled
+	CollisionError CollisionStrategy = iota
+	// CollisionHashSuffix appends hash of route template to metric name taken by another route
+	CollisionHashSuffix
+	// CollisionLabel labels metrics of every route by route template,
+	// so routes with the same metric name share metric families
+	CollisionLabel
+)
+
+type routeOptions struct {
+	isFailure   FailureClassifier
+	constLabels prometheus.Labels
+	disabled    bool
+	// help texts of metrics of the route by metric kind
+	helps map[MetricKind]string
+}
+
+// WithRegisterer sets registerer of created metrics, prometheus.DefaultRegisterer is used by default
+func WithRegisterer(registerer prometheus.Registerer) Option {
+	return func(h *handler) {
+		h.registerer = registerer
+	}
+}
+
+// WithNamespace sets namespace (prefix) of metric names, service name is used by default
+func WithNamespace(namespace string) Option {
+	return func(h *handler) {
+		h.namespace = namespace
+	}
+}
+
+// WithSubsystem sets subsystem of metric names placed between namespace and route, empty by default
+func WithSubsystem(subsystem string) Option {
+	return func(h *handler) {
+		h.subsystem = subsystem
+	}
+}
+
+// WithConstLabels sets labels added to every metric
+func WithConstLabels(labels prometheus.Labels) Option {
+	return func(h *handler) {
+		h.constLabels = labels
+	}
+}
+
+// WithDurationBuckets sets buckets of request duration histograms (in seconds).
+// prometheus.DefBuckets are used by default
+func WithDurationBuckets(buckets []float64) Option {
+	return func(h *handler) {
+		h.durationBuckets = buckets
+	}
+}
+
+// WithLabeledMetrics makes all routes share http_requests_total, http_requests_failure_total
+// and http_request_duration_seconds metric families labeled by route template, method and status
+// instead of creating metric names per route
+func WithLabeledMetrics() Option {
+	return func(h *handler) {
+		h.labeled = true
+	}
+}
+
+// WithFailureClassifier sets classifier of failed requests for all routes.
+// By default request is failed if response status code >= 400
+func WithFailureClassifier(isFailure FailureClassifier) Option {
+	return func(h *handler) {
+		h.isFailure = isFailure
+	}
+}
+
+// WithRouteFailureClassifier overrides classifier of failed requests for the route
+func WithRouteFailureClassifier(isFailure FailureClassifier) RouteOption {
+	return func(o *routeOptions) {
+		o.isFailure = isFailure
+	}
+}
+
+// WithSizeBuckets sets buckets of request and response size histograms (in bytes).
+// Exponential buckets from 100B to 10MB are used by default
+func WithSizeBuckets(buckets []float64) Option {
+	return func(h *handler) {
+		h.sizeBuckets = buckets
+	}
+}
+
+// WithRouteConstLabels adds labels to every metric of the route, e.g. owning team or API version,
+// labels of several options (e.g. of group and route) are merged and override labels of WithConstLabels.
+// Registration of the route fails with ErrInvalidRouteLabel if label overrides label set by library,
+// e.g. http_method, or label names differ from label names of metrics with the same name registered before,
+// e.g. of the same route with another http method.
+// Labels are ignored in labeled mode because metric families are shared by all routes
+func WithRouteConstLabels(labels prometheus.Labels) RouteOption {
+	return func(o *routeOptions) {
+		if o.constLabels == nil {
+			o.constLabels = make(prometheus.Labels, len(labels))
+		}
+		for name, value := range labels {
+			o.constLabels[name] = value
+		}
+	}
+}
+
+// WithRouteHelp overrides help text of metric of given kind of the route, e.g. "Total requests of user profile".
+// Metrics with the same name share help text of the first registered one, e.g. metrics of GET and POST requests
+// to /user/:id, because help text is exposed per metric family. Registration of the route fails
+// with ErrHelpConflict if help text differs from the shared one. Help text is ignored in labeled mode
+func WithRouteHelp(kind MetricKind, help string) RouteOption {
+	return func(o *routeOptions) {
+		if o.helps == nil {
+			o.helps = make(map[MetricKind]string, 1)
+		}
+		o.helps[kind] = help
+	}
+}
+
+// WithoutRouteInstrumentation disables metrics of the route
+func WithoutRouteInstrumentation() RouteOption {
+	return func(o *routeOptions) {
+		o.disabled = true
+	}
+}
+
+// WithRouteResolver sets resolver of route templates of requests instrumented by Middleware.
+// Resolved templates must be declared by Declare, otherwise requests are counted as unmatched
+func WithRouteResolver(resolveRoute RouteResolver) Option {
+	return func(h *handler) {
+		h.resolveRoute = resolveRoute
+	}
+}
+
+// WithPanicRecovery sets handler which writes response of request which route handler panicked,
+// status 500 is set before handler is called. By default panic is re-raised after it's counted
+func WithPanicRecovery(recoverHandler func(ctx *fasthttp.RequestCtx, recovered interface{})) Option {
+	return func(h *handler) {
+		h.recoverHandler = recoverHandler
+	}
+}
+
+// WithCollisionStrategy sets strategy of resolving metric name collisions of routes, CollisionError by default.
+// Strategy is ignored in labeled mode because metric families are shared by all routes
+func WithCollisionStrategy(strategy CollisionStrategy) Option {
+	return func(h *handler) {
+		h.collisionStrategy = strategy
+	}
+}
+
+// WithMetricNamer sets namer of per route metrics, NewDefaultMetricNamer of namespace and subsystem is used by default.
+// Namer is ignored in labeled mode, service-wide metrics are named by namespace and subsystem anyway
+func WithMetricNamer(namer MetricNamer) Option {
+	return func(h *handler) {
+		h.namer = namer
+	}
+}
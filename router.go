@@ -0,0 +1,129 @@
+package fasthttpprometheus
+
+import (
+	"strings"
+
+	"github.com/buaazp/fasthttprouter"
+	fastrouter "github.com/fasthttp/router"
+	"github.com/valyala/fasthttp"
+)
+
+// Router dispatches requests to handlers registered for method and route template.
+// Use NewFasthttprouterAdapter for github.com/buaazp/fasthttprouter
+// and NewFasthttpRouterAdapter for github.com/fasthttp/router
+type Router interface {
+	Handle(method, path string, handle fasthttp.RequestHandler)
+	Handler(ctx *fasthttp.RequestCtx)
+	// FilesHandler returns handler which router registers on GET path to serve files from rootPath,
+	// path must end with catch-all parameter
+	FilesHandler(path string, rootPath string) fasthttp.RequestHandler
+	Lookup(method, path string, ctx *fasthttp.RequestCtx) (fasthttp.RequestHandler, bool)
+	SetNotFound(handler fasthttp.RequestHandler)
+	SetMethodNotAllowed(handler fasthttp.RequestHandler)
+	SetPanicHandler(handler func(ctx *fasthttp.RequestCtx, recovered interface{}))
+}
+
+type fasthttprouterAdapter struct {
+	router *fasthttprouter.Router
+}
+
+// NewFasthttprouterAdapter returns Router of github.com/buaazp/fasthttprouter,
+// route templates use :param and *catchall syntax
+func NewFasthttprouterAdapter(router *fasthttprouter.Router) Router {
+	return &fasthttprouterAdapter{router: router}
+}
+
+func (a *fasthttprouterAdapter) Handle(method, path string, handle fasthttp.RequestHandler) {
+	a.router.Handle(method, path, handle)
+}
+
+func (a *fasthttprouterAdapter) Handler(ctx *fasthttp.RequestCtx) {
+	a.router.Handler(ctx)
+}
+
+// FilesHandler returns handler like fasthttprouter.Router.ServeFiles does
+func (a *fasthttprouterAdapter) FilesHandler(path string, rootPath string) fasthttp.RequestHandler {
+	if len(path) < 10 || path[len(path)-10:] != "/*filepath" {
+		panic("path must end with /*filepath in path '" + path + "'")
+	}
+	prefix := path[:len(path)-10]
+
+	return fasthttp.FSHandler(rootPath, strings.Count(prefix, "/"))
+}
+
+func (a *fasthttprouterAdapter) Lookup(
+	method, path string,
+	ctx *fasthttp.RequestCtx,
+) (fasthttp.RequestHandler, bool) {
+	return a.router.Lookup(method, path, ctx)
+}
+
+func (a *fasthttprouterAdapter) SetNotFound(handler fasthttp.RequestHandler) {
+	a.router.NotFound = handler
+}
+
+func (a *fasthttprouterAdapter) SetMethodNotAllowed(handler fasthttp.RequestHandler) {
+	a.router.MethodNotAllowed = handler
+}
+
+func (a *fasthttprouterAdapter) SetPanicHandler(handler func(ctx *fasthttp.RequestCtx, recovered interface{})) {
+	a.router.PanicHandler = handler
+}
+
+type fasthttpRouterAdapter struct {
+	router *fastrouter.Router
+}
+
+// NewFasthttpRouterAdapter returns Router of github.com/fasthttp/router,
+// route templates use {param}, {param?}, {param:regex} and {catchall:*} syntax
+func NewFasthttpRouterAdapter(router *fastrouter.Router) Router {
+	return &fasthttpRouterAdapter{router: router}
+}
+
+func (a *fasthttpRouterAdapter) Handle(method, path string, handle fasthttp.RequestHandler) {
+	a.router.Handle(method, path, handle)
+}
+
+func (a *fasthttpRouterAdapter) Handler(ctx *fasthttp.RequestCtx) {
+	a.router.Handler(ctx)
+}
+
+// FilesHandler returns handler like router.Router.ServeFiles does
+func (a *fasthttpRouterAdapter) FilesHandler(path string, rootPath string) fasthttp.RequestHandler {
+	const suffix = "/{filepath:*}"
+	if !strings.HasSuffix(path, suffix) {
+		panic("path must end with " + suffix + " in path '" + path + "'")
+	}
+	prefix := path[:len(path)-len(suffix)]
+
+	fs := &fasthttp.FS{
+		Root:               rootPath,
+		IndexNames:         []string{"index.html"},
+		GenerateIndexPages: true,
+		AcceptByteRange:    true,
+	}
+	if stripSlashes := strings.Count(prefix, "/"); stripSlashes > 0 {
+		fs.PathRewrite = fasthttp.NewPathSlashesStripper(stripSlashes)
+	}
+
+	return fs.NewRequestHandler()
+}
+
+func (a *fasthttpRouterAdapter) Lookup(
+	method, path string,
+	ctx *fasthttp.RequestCtx,
+) (fasthttp.RequestHandler, bool) {
+	return a.router.Lookup(method, path, ctx)
+}
+
+func (a *fasthttpRouterAdapter) SetNotFound(handler fasthttp.RequestHandler) {
+	a.router.NotFound = handler
+}
+
+func (a *fasthttpRouterAdapter) SetMethodNotAllowed(handler fasthttp.RequestHandler) {
+	a.router.MethodNotAllowed = handler
+}
+
+func (a *fasthttpRouterAdapter) SetPanicHandler(handler func(ctx *fasthttp.RequestCtx, recovered interface{})) {
+	a.router.PanicHandler = handler
+}
@@ -0,0 +1,227 @@
+package fasthttpprometheus
+
+import (
+	"testing"
+
+	"github.com/buaazp/fasthttprouter"
+	fastrouter "github.com/fasthttp/router"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/suite"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+type routerSuite struct {
+	suite.Suite
+
+	handler *handler
+}
+
+func TestRouterSuite(t *testing.T) {
+	suite.Run(t, &routerSuite{})
+}
+
+func (s *routerSuite) SetupTest() {
+	s.handler = NewRouterHandler(
+		NewFasthttpRouterAdapter(fastrouter.New()),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(prometheus.NewRegistry()),
+	)
+}
+
+func (s *routerSuite) TestParams() {
+	s.handler.GET("/user/{id}/action-1", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.GET("/article/{id:[0-9]+}", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.GET("/file/{name}.{ext}", func(ctx *fasthttp.RequestCtx) {})
+
+	for path, desc := range map[string]struct {
+		metricName string
+		routeName  string
+	}{
+		"/user/1/action-1": {"test_service_user_id_var_action_1_requests_total", "user_id_var_action_1"},
+		"/article/1":       {"test_service_article_id_var_requests_total", "article_id_var"},
+		"/file/app.js":     {"test_service_file_name_ext_var_requests_total", "file_name_ext_var"},
+	} {
+		ctx := newRequestCtx("GET", path)
+		s.handler.Handler(ctx)
+		s.Equal(fasthttp.StatusOK, ctx.Response.StatusCode(), path)
+
+		leaf := s.handler.routes()["GET"].getLeaf(path)
+		s.Equal(
+			"Desc{fqName: \""+desc.metricName+"\", help: \"Total requests to routes named "+desc.routeName+"\", "+
+				"constLabels: {http_method=\"GET\"}, variableLabels: []}",
+			leaf.metrics[metricTypeTotal].Desc().String(),
+		)
+		s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeTotal]), path)
+	}
+}
+
+func (s *routerSuite) TestOptionalParams() {
+	s.handler.GET("/user/{name?}", func(ctx *fasthttp.RequestCtx) {})
+
+	s.handler.Handler(newRequestCtx("GET", "/user"))
+	s.handler.Handler(newRequestCtx("GET", "/user/john"))
+
+	leaf := s.handler.routes()["GET"].getLeaf("/user/john")
+	s.Equal(
+		"Desc{fqName: \"test_service_user_name_var_requests_total\", "+
+			"help: \"Total requests to routes named user_name_var\", "+
+			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
+		leaf.metrics[metricTypeTotal].Desc().String(),
+	)
+	s.Equal(float64(2), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	s.Equal(leaf.metrics, s.handler.routes()["GET"].getLeaf("/user").metrics)
+	s.Equal(0, testutil.CollectAndCount(s.handler.unmatched))
+}
+
+func (s *routerSuite) TestOptionalParamsRegex() {
+	s.handler.GET("/user/{name?:[a-z]+}", func(ctx *fasthttp.RequestCtx) {})
+
+	s.handler.Handler(newRequestCtx("GET", "/user"))
+	s.handler.Handler(newRequestCtx("GET", "/user/john"))
+
+	leaf := s.handler.routes()["GET"].getLeaf("/user/john")
+	s.Equal(float64(2), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+	s.Equal(leaf.metrics, s.handler.routes()["GET"].getLeaf("/user").metrics)
+	s.Equal(0, testutil.CollectAndCount(s.handler.unmatched))
+}
+
+func (s *routerSuite) TestOptionalParamsLabeled() {
+	s.handler = NewRouterHandler(
+		NewFasthttpRouterAdapter(fastrouter.New()),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(prometheus.NewRegistry()),
+		WithLabeledMetrics(),
+	)
+	s.handler.GET("/{lang?}", func(ctx *fasthttp.RequestCtx) {})
+
+	s.handler.Handler(newRequestCtx("GET", "/"))
+	s.handler.Handler(newRequestCtx("GET", "/en"))
+
+	s.Equal(
+		float64(2),
+		testutil.ToFloat64(s.handler.vecs[metricTypeTotal].WithLabelValues("/{lang?}", "GET", "200")),
+	)
+}
+
+func (s *routerSuite) TestServeFiles() {
+	s.handler.ServeFiles("/static/{filepath:*}", s.T().TempDir())
+
+	ctx := newRequestCtx("GET", "/static/app.js")
+	s.handler.Handler(ctx)
+	s.Equal(fasthttp.StatusNotFound, ctx.Response.StatusCode())
+
+	leaf := s.handler.routes()["GET"].getLeaf("/static/app.js")
+	s.Equal(
+		"Desc{fqName: \"test_service_static_filepath_all_requests_total\", "+
+			"help: \"Total requests to routes named static_filepath_all\", "+
+			"constLabels: {http_method=\"GET\"}, variableLabels: []}",
+		leaf.metrics[metricTypeTotal].Desc().String(),
+	)
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+}
+
+func (s *routerSuite) TestMethodWild() {
+	s.handler.Handle(fastrouter.MethodWild, "/any", func(ctx *fasthttp.RequestCtx) {})
+
+	s.handler.Handler(newRequestCtx("GET", "/any"))
+	s.handler.Handler(newRequestCtx("PROPFIND", "/any"))
+
+	leaf := s.handler.routes()[methodWild].getLeaf("/any")
+	s.Equal(float64(2), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+}
+
+func (s *routerSuite) TestNotFound() {
+	s.handler.NotFound(func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusTeapot)
+	})
+
+	ctx := newRequestCtx("GET", "/none")
+	s.handler.Handler(ctx)
+
+	s.Equal(fasthttp.StatusTeapot, ctx.Response.StatusCode())
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.unmatched.WithLabelValues("GET", reasonNotFound)))
+}
+
+func (s *routerSuite) TestFasthttprouterAdapter() {
+	router := fasthttprouter.New()
+	s.handler = NewRouterHandler(
+		NewFasthttprouterAdapter(router),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(prometheus.NewRegistry()),
+	)
+	s.handler.GET("/user/:id", func(ctx *fasthttp.RequestCtx) {})
+
+	handle, _ := router.Lookup("GET", "/user/1", nil)
+	s.NotNil(handle)
+
+	s.handler.Handler(newRequestCtx("GET", "/user/1"))
+	leaf := s.handler.routes()["GET"].getLeaf("/user/1")
+	s.Equal(float64(1), testutil.ToFloat64(leaf.metrics[metricTypeTotal]))
+}
+
+func (s *routerSuite) TestMatchedRoute() {
+	s.handler = NewRouterHandler(
+		NewFasthttpRouterAdapter(fastrouter.New()),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(prometheus.NewRegistry()),
+		WithLabeledMetrics(),
+	)
+	s.handler.GET("/user/{id:[0-9]+}", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.GET("/user/{id:[0-9]+}/orders", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.GET("/user/{name}/orders/{page:[0-9]+}", func(ctx *fasthttp.RequestCtx) {})
+
+	s.handler.Handler(newRequestCtx("GET", "/user/1"))
+	s.handler.Handler(newRequestCtx("GET", "/user/john/orders/1"))
+	// regular expression of route doesn't match
+	s.handler.Handler(newRequestCtx("GET", "/user/john"))
+	// router redirects to /user/1
+	s.handler.Handler(newRequestCtx("GET", "/user/1/"))
+
+	total := s.handler.vecs[metricTypeTotal]
+	s.Equal(2, testutil.CollectAndCount(total))
+	s.Equal(float64(1), testutil.ToFloat64(total.WithLabelValues("/user/{id:[0-9]+}", "GET", "200")))
+	s.Equal(float64(1), testutil.ToFloat64(total.WithLabelValues("/user/{name}/orders/{page:[0-9]+}", "GET", "200")))
+	s.Equal(float64(1), testutil.ToFloat64(s.handler.unmatched.WithLabelValues("GET", reasonNotFound)))
+}
+
+func (s *routerSuite) TestMatchedRouteInFlight() {
+	var inFlight float64
+	s.handler.GET("/user/{id}", func(ctx *fasthttp.RequestCtx) {
+		leaf := s.handler.routes()["GET"].getLeaf("/user/1")
+		inFlight = testutil.ToFloat64(leaf.gauges[metricTypeInFlight])
+	})
+
+	s.handler.Handler(newRequestCtx("GET", "/user/1"))
+
+	leaf := s.handler.routes()["GET"].getLeaf("/user/1")
+	s.Equal(float64(1), inFlight)
+	s.Equal(float64(0), testutil.ToFloat64(leaf.gauges[metricTypeInFlight]))
+	s.Equal(float64(0), testutil.ToFloat64(s.handler.inFlight))
+}
+
+func (s *routerSuite) TestMatchedRouteRemoved() {
+	s.handler = NewRouterHandler(
+		NewFasthttpRouterAdapter(fastrouter.New()),
+		"test_service",
+		zap.NewNop(),
+		WithRegisterer(prometheus.NewRegistry()),
+		WithLabeledMetrics(),
+	)
+	s.handler.GET("/user/{id}", func(ctx *fasthttp.RequestCtx) {})
+	s.handler.Handler(newRequestCtx("GET", "/user/1"))
+
+	s.True(s.handler.Remove("GET", "/user/{id}"))
+	// route is still served by router but isn't counted
+	ctx := newRequestCtx("GET", "/user/1")
+	s.handler.Handler(ctx)
+
+	s.Equal(fasthttp.StatusOK, ctx.Response.StatusCode())
+	s.Equal(0, testutil.CollectAndCount(s.handler.vecs[metricTypeTotal]))
+	s.Equal(0, testutil.CollectAndCount(s.handler.unmatched))
+}
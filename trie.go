@@ -1,9 +1,18 @@
 package fasthttpprometheus
 
 import (
+	"strings"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// priorities of node matching, see getLeaf
+const (
+	staticPriority int = iota
+	paramPriority
+	catchAllPriority
+)
+
 // prefix tree node
 // every node contains route part and may contain child nodes and metrics
 // for example you have two routes:
@@ -20,44 +29,156 @@ import (
 // _action-1_____action_2_
 // _metrics_______metrics_
 //
-// leaf with part = action contains total and failure_total metrics for full route
+// catch-all parameter (e.g. /static/*filepath) is always a leaf and matches the rest of path
+//
+// leaf with part = action contains total and failure_total metrics, status counters,
+// in-flight requests gauge and duration histogram for full route
+// (in labeled mode total and failure_total are stored in vecs curried by route and method)
 type node struct {
-	path     string
-	children []*node
-	metrics  map[string]prometheus.Counter
+	path       string
+	children   []*node
+	metrics    map[string]prometheus.Counter
+	vecs       map[string]*prometheus.CounterVec
+	histograms map[string]prometheus.Histogram
+	gauges     map[string]prometheus.Gauge
+	// overrides failure classifier of handler for the route
+	isFailure FailureClassifier
+	// route is registered without instrumentation
+	disabled bool
 }
 
-// getLeaf returns leaf with metrics for full route
+// getLeaf returns leaf with metrics for full route.
+// Children are matched by priority of fasthttprouter regardless of registration order:
+// static part beats parameter which beats catch-all parameter, e.g. /user/me beats /user/:id
 func (n *node) getLeaf(path string) *node {
+	leaf, _ := n.lookup(path)
+
+	return leaf
+}
+
+// lookup returns leaf of path and reports if router redirects path instead of matching any route
+func (n *node) lookup(path string) (*node, bool) {
 	for i := 0; i < len(path); i++ {
 		if i == len(path)-1 {
-			return n.loopChildren(path, i+1)
+			return n.matchLast(path)
 		}
 
 		if path[i] == slashByte && i > 0 {
-			if cn := n.loopChildren(path, i+1); cn != nil {
-				return cn.getLeaf(path[i:])
+			return n.matchPart(path[:i+1], path[i:])
+		}
+	}
+
+	return nil, false
+}
+
+// matchLast returns child matching the last part of path,
+// child which is only a part of longer routes is returned if no leaf matches, e.g. /hello/ of /api/hello/:name
+func (n *node) matchLast(part string) (*node, bool) {
+	var routePart *node
+	for priority := staticPriority; priority <= catchAllPriority; priority++ {
+		// router redirects path to static part with catch-all parameter, e.g. /static to /static/ of /static/*filepath,
+		// instead of matching parameter of lower priority
+		if priority == paramPriority && part[len(part)-1] != slashByte && n.hasCatchAllUnder(part) {
+			return nil, true
+		}
+
+		for _, child := range n.children {
+			if child.priority() != priority || !child.matches(part) {
+				continue
 			}
 
-			return nil
+			// catch-all parameter matches empty rest of path too, e.g. /static/ for /static/*filepath
+			if part[len(part)-1] == slashByte {
+				if catchAll := child.catchAllChild(); catchAll != nil {
+					child = catchAll
+				}
+			}
+			if !child.isLeaf() {
+				if routePart == nil {
+					routePart = child
+				}
+				continue
+			}
+
+			return child, false
 		}
 	}
 
-	return nil
+	return routePart, false
 }
 
-func (n *node) loopChildren(path string, offset int) *node {
-	localPath := path[:offset]
+// matchPart returns leaf of the rest of path under child matching the part of path,
+// next matching child is tried if the rest of path doesn't match leaf under child of higher priority
+func (n *node) matchPart(part string, rest string) (*node, bool) {
+	var routePart *node
+	for priority := staticPriority; priority <= catchAllPriority; priority++ {
+		for _, child := range n.children {
+			if child.priority() != priority || !child.matches(part) {
+				continue
+			}
+
+			leaf, redirect := child, false
+			if !child.isCatchAll() {
+				leaf, redirect = child.lookup(rest)
+			}
+			if redirect || leaf != nil && leaf.isLeaf() {
+				return leaf, redirect
+			}
+			if routePart == nil {
+				routePart = leaf
+			}
+		}
+	}
+
+	return routePart, false
+}
+
+// hasCatchAllUnder reports if static child part/ has catch-all child
+func (n *node) hasCatchAllUnder(part string) bool {
 	for _, child := range n.children {
-		if child.path == localPath {
-			return child
+		if len(child.path) == len(part)+1 && child.path[:len(part)] == part && child.catchAllChild() != nil {
+			return true
 		}
-		if child.path[1] == colonByte {
-			if child.path[len(child.path)-1] == slashByte && localPath[len(localPath)-1] == slashByte {
-				return child
-			} else if child.path[len(child.path)-1] != slashByte && localPath[len(localPath)-1] != slashByte {
-				return child
-			}
+	}
+
+	return false
+}
+
+// priority returns priority of node matching, lower is higher
+func (n *node) priority() int {
+	if n.isCatchAll() {
+		return catchAllPriority
+	}
+	if n.isParam() {
+		return paramPriority
+	}
+
+	return staticPriority
+}
+
+// matches reports if node matches part of path, parameter matches part with the same trailing slash
+func (n *node) matches(part string) bool {
+	if n.isCatchAll() || n.path == part {
+		return true
+	}
+
+	return n.isParam() && (n.path[len(n.path)-1] == slashByte) == (part[len(part)-1] == slashByte)
+}
+
+// isParam reports if node is parameter, e.g. /:id
+func (n *node) isParam() bool {
+	return len(n.path) > 1 && n.path[1] == colonByte
+}
+
+// isCatchAll reports if node is catch-all parameter, e.g. /*filepath
+func (n *node) isCatchAll() bool {
+	return len(n.path) > 1 && n.path[1] == asteriskByte
+}
+
+func (n *node) catchAllChild() *node {
+	for _, child := range n.children {
+		if child.isCatchAll() {
+			return child
 		}
 	}
 
@@ -69,6 +190,13 @@ func (n *node) addPath(fullPath string, metricName *string) *node {
 	for i := 0; i < len(fullPath); i++ {
 		if i == len(fullPath)-1 {
 			processMetricName(fullPath, metricName)
+			// node of route may exist as a part of longer routes, e.g. /hello/ of /api/hello/:name
+			for _, child := range n.children {
+				if child.path == fullPath {
+					return child
+				}
+			}
+
 			cn := &node{path: fullPath}
 
 			if len(n.children) > 0 {
@@ -101,9 +229,225 @@ func (n *node) addPath(fullPath string, metricName *string) *node {
 	return nil
 }
 
+// removePath removes leaf of route from the trie and returns it or nil if route isn't found,
+// nodes left without children are removed too
+func (n *node) removePath(fullPath string) *node {
+	for i := 0; i < len(fullPath); i++ {
+		if i == len(fullPath)-1 {
+			for j, child := range n.children {
+				if child.path != fullPath || !child.isLeaf() {
+					continue
+				}
+				// leaf of route is a part of longer routes too, e.g. /hello/ of /api/hello/ and /api/hello/:name
+				if len(child.children) > 0 {
+					leaf := *child
+					child.metrics, child.vecs, child.histograms, child.gauges = nil, nil, nil, nil
+					child.isFailure, child.disabled = nil, false
+
+					return &leaf
+				}
+
+				n.removeChild(j)
+
+				return child
+			}
+
+			return nil
+		}
+
+		if fullPath[i] == slashByte && i > 0 {
+			localPath := fullPath[:i+1]
+			for j, child := range n.children {
+				if child.path != localPath {
+					continue
+				}
+
+				leaf := child.removePath(fullPath[i:])
+				if leaf != nil && len(child.children) == 0 && !child.isLeaf() {
+					n.removeChild(j)
+				}
+
+				return leaf
+			}
+
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// isLeaf reports if node is the last part of registered route
+func (n *node) isLeaf() bool {
+	return n.disabled || n.metrics != nil || n.vecs != nil || n.histograms != nil || n.gauges != nil
+}
+
+func (n *node) removeChild(i int) {
+	children := make([]*node, 0, len(n.children)-1)
+	children = append(children, n.children[:i]...)
+	n.children = append(children, n.children[i+1:]...)
+}
+
 func (n *node) appendChild(offset int, localPath string, fullPath string, metricName *string) *node {
 	child := &node{path: localPath}
 	n.children = append(n.children, child)
 
 	return child.addPath(fullPath[offset:], metricName)
 }
+
+// shareMetrics makes node use metrics of the leaf, e.g. for /user of route /user/{name?}
+func (n *node) shareMetrics(leaf *node) {
+	n.metrics = leaf.metrics
+	n.vecs = leaf.vecs
+	n.histograms = leaf.histograms
+	n.gauges = leaf.gauges
+	n.isFailure = leaf.isFailure
+	n.disabled = leaf.disabled
+}
+
+// normalizePath converts route of fasthttp/router to syntax of the trie:
+// /user/{id} and /user/{id:[0-9]+} to /user/:id, /static/{filepath:*} to /static/*filepath,
+// several parameters of one part are joined, e.g. /file/{name}.{ext} to /file/:name_ext
+func normalizePath(path string) string {
+	if strings.IndexByte(path, openBraceByte) < 0 {
+		return path
+	}
+
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if strings.IndexByte(part, openBraceByte) < 0 {
+			continue
+		}
+
+		names, catchAll := parseParams(part)
+		if catchAll {
+			parts[i] = "*" + strings.Join(names, "_")
+		} else {
+			parts[i] = ":" + strings.Join(names, "_")
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// parseParams returns names of parameters of route part, e.g. name and ext of {name}.{ext},
+// and reports if parameter is catch-all, e.g. {filepath:*}
+func parseParams(part string) ([]string, bool) {
+	var (
+		names    []string
+		catchAll bool
+	)
+	for i := 0; i < len(part); i++ {
+		if part[i] != openBraceByte {
+			continue
+		}
+
+		// regular expression of parameter may contain braces, e.g. {id:[0-9]{3}}
+		depth, end := 1, len(part)
+		for j := i + 1; j < len(part); j++ {
+			if part[j] == openBraceByte {
+				depth++
+			} else if part[j] == closeBraceByte {
+				depth--
+			}
+			if depth == 0 {
+				end = j
+				break
+			}
+		}
+
+		param := part[i+1 : end]
+		name := param
+		if colon := strings.IndexByte(param, colonByte); colon >= 0 {
+			name = param[:colon]
+			catchAll = param[colon+1:] == "*"
+		}
+		names = append(names, strings.TrimSuffix(name, "?"))
+		i = end
+	}
+
+	return names, catchAll
+}
+
+// optionalPaths returns paths matched by route with optional parameters of fasthttp/router,
+// e.g. /user/{name?} and /user/{name?:[a-z]+} match /user and /user/{name}. Full route is the last path
+func optionalPaths(path string) []string {
+	if strings.IndexByte(path, questionByte) < 0 {
+		return []string{path}
+	}
+
+	parts := strings.Split(path, "/")
+	paths := make([]string, 0, len(parts))
+	for i, part := range parts {
+		question := optionalParamIndex(part)
+		if question < 0 {
+			continue
+		}
+
+		optionalPath := strings.Join(parts[:i], "/")
+		if optionalPath == "" {
+			optionalPath = "/"
+		}
+		paths = append(paths, optionalPath)
+		parts[i] = part[:question] + part[question+1:]
+	}
+
+	return append(paths, strings.Join(parts, "/"))
+}
+
+// optionalParamIndex returns index of "?" of optional parameter of route part, e.g. {name?} or {name?:[a-z]+},
+// or -1 if part isn't optional parameter. Like fasthttp/router "?" must follow parameter name,
+// so "?" of regular expression, e.g. {id:[0-9]?}, doesn't make parameter optional
+func optionalParamIndex(part string) int {
+	if len(part) < 4 || part[0] != openBraceByte || part[len(part)-1] != closeBraceByte {
+		return -1
+	}
+
+	for i := 1; i < len(part)-1; i++ {
+		switch part[i] {
+		case questionByte:
+			return i
+		case colonByte, openBraceByte, closeBraceByte:
+			return -1
+		}
+	}
+
+	return -1
+}
+
+// clone returns deep copy of the node, metrics are shared by copies
+func (n *node) clone() *node {
+	cn := *n
+	if n.children != nil {
+		cn.children = make([]*node, len(n.children))
+		for i, child := range n.children {
+			cn.children[i] = child.clone()
+		}
+	}
+	if n.metrics != nil {
+		cn.metrics = make(map[string]prometheus.Counter, len(n.metrics))
+		for metricType, metric := range n.metrics {
+			cn.metrics[metricType] = metric
+		}
+	}
+	if n.vecs != nil {
+		cn.vecs = make(map[string]*prometheus.CounterVec, len(n.vecs))
+		for metricType, vec := range n.vecs {
+			cn.vecs[metricType] = vec
+		}
+	}
+	if n.histograms != nil {
+		cn.histograms = make(map[string]prometheus.Histogram, len(n.histograms))
+		for metricType, histogram := range n.histograms {
+			cn.histograms[metricType] = histogram
+		}
+	}
+	if n.gauges != nil {
+		cn.gauges = make(map[string]prometheus.Gauge, len(n.gauges))
+		for metricType, gauge := range n.gauges {
+			cn.gauges[metricType] = gauge
+		}
+	}
+
+	return &cn
+}
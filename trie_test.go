@@ -1,8 +1,15 @@
 package fasthttpprometheus
 
 import (
+	"math/rand"
+	"strconv"
+	"strings"
 	"testing"
 
+	fastrouter "github.com/fasthttp/router"
+	"github.com/valyala/fasthttp"
+
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -68,92 +75,96 @@ func (s *trieSuite) TestGetLeaf() {
 	s.Nil(leaf)
 }
 
-func (s *trieSuite) TestLoopChildren() {
+func (s *trieSuite) TestGetLeafCatchAll() {
+	var metricName, metricName2, metricName3 string
+	s.node.addPath("/static/*filepath", &metricName)
+	s.node.addPath("/api/:version/docs/*page", &metricName2)
+	s.node.addPath("/ping", &metricName3)
+
+	staticLeaf := &node{
+		path: "/*filepath",
+	}
+	s.Equal(staticLeaf, s.node.getLeaf("/static/app.js"))
+	s.Equal(staticLeaf, s.node.getLeaf("/static/css/app.css"))
+	s.Equal(staticLeaf, s.node.getLeaf("/static/css/"))
+	s.Equal(staticLeaf, s.node.getLeaf("/static/"))
+
+	docsLeaf := &node{
+		path: "/*page",
+	}
+	s.Equal(docsLeaf, s.node.getLeaf("/api/v1/docs/index.html"))
+	s.Equal(docsLeaf, s.node.getLeaf("/api/v2/docs/guide/routes"))
+	s.Equal(docsLeaf, s.node.getLeaf("/api/v2/docs/"))
+
+	s.Equal(&node{path: "/ping"}, s.node.getLeaf("/ping"))
+	s.Nil(s.node.getLeaf("/api/v1/nodocs/index.html"))
+}
+
+func (s *trieSuite) TestMatchLast() {
 	var metricName, metricName2, metricName3, metricName4, metricName5 string
 	s.node.addPath("/ping", &metricName)
-	s.node.addPath("/user/:id/action-1", &metricName2)
-	s.node.addPath("/user/:id/action-2", &metricName3)
+	s.node.addPath("/:name", &metricName2)
+	s.node.addPath("/static/*filepath", &metricName3)
 	s.node.addPath("/api/hello/", &metricName4)
 	s.node.addPath("/api/hello/:name", &metricName5)
 
-	child := s.node.loopChildren("", 0)
-	s.Nil(child)
+	leaf, redirect := s.node.matchLast("/ping")
+	s.Equal(&node{path: "/ping"}, leaf)
+	s.False(redirect)
 
-	child = s.node.loopChildren("/ping", 5)
-	s.Equal(&node{
-		path: "/ping",
-	}, child)
+	leaf, redirect = s.node.matchLast("/pong")
+	s.Equal(&node{path: "/:name"}, leaf)
+	s.False(redirect)
 
-	userNode := s.node.loopChildren("/user/1/action-1", 6)
-	s.Equal(&node{
-		path: "/user/",
-		children: []*node{
-			{
-				path: "/:id/",
-				children: []*node{
-					{
-						path: "/action-1",
-					},
-					{
-						path: "/action-2",
-					},
-				},
-			},
-		},
-	}, userNode)
-
-	idNode := userNode.loopChildren("/1/action-1", 3)
-	s.Equal(&node{
-		path: "/:id/",
-		children: []*node{
-			{
-				path: "/action-1",
-			},
-			{
-				path: "/action-2",
-			},
-		},
-	}, idNode)
-
-	actionOneNode := idNode.loopChildren("/action-1", 9)
-	s.Equal(&node{
-		path: "/action-1",
-	}, actionOneNode)
+	// router redirects /static to /static/
+	leaf, redirect = s.node.matchLast("/static")
+	s.Nil(leaf)
+	s.True(redirect)
 
-	actionTwoNode := idNode.loopChildren("/action-2", 9)
-	s.Equal(&node{
-		path: "/action-2",
-	}, actionTwoNode)
+	leaf, redirect = s.node.getLeaf("/api/hello/").matchLast("/test")
+	s.Equal(&node{path: "/:name"}, leaf)
+	s.False(redirect)
 
-	apiNode := s.node.loopChildren("/api/hello/", 5)
-	s.Equal(&node{
-		path: "/api/",
-		children: []*node{
-			{
-				path: "/hello/",
-				children: []*node{
-					{
-						path: "/:name",
-					},
-				},
-			},
-		},
-	}, apiNode)
+	leaf, redirect = s.node.getLeaf("/api/hello/").matchLast("/test/")
+	s.Nil(leaf)
+	s.False(redirect)
+}
 
-	helloNode := apiNode.loopChildren("/hello/", 7)
-	s.Equal(&node{
-		path: "/hello/",
-		children: []*node{
-			{
-				path: "/:name",
-			},
-		},
-	}, helloNode)
+func (s *trieSuite) TestMatches() {
+	for _, tc := range []struct {
+		path    string
+		part    string
+		matches bool
+	}{
+		{path: "/user/", part: "/user/", matches: true},
+		{path: "/user/", part: "/user", matches: false},
+		{path: "/:id/", part: "/1/", matches: true},
+		{path: "/:id/", part: "/1", matches: false},
+		{path: "/:id", part: "/1", matches: true},
+		{path: "/:id", part: "/1/", matches: false},
+		{path: "/*filepath", part: "/app.js", matches: true},
+		{path: "/*filepath", part: "/css/", matches: true},
+		{path: "/", part: "/", matches: true},
+	} {
+		s.Equal(tc.matches, (&node{path: tc.path}).matches(tc.part), tc.path+" "+tc.part)
+	}
+}
 
-	nameVarNode := helloNode.loopChildren("/test", 5)
-	s.Equal(&node{
-		path: "/:name",
-	}, nameVarNode)
+func (s *trieSuite) TestGetLeafPriority() {
+	var metricName, metricName2, metricName3, metricName4, metricName5 string
+	// routes are registered in reverse order of priority
+	s.node.addPath("/user/*path", &metricName)
+	s.node.addPath("/user/:id", &metricName2)
+	s.node.addPath("/user/me", &metricName3)
+	s.node.addPath("/user/:id/orders", &metricName4)
+	s.node.addPath("/user/me/settings", &metricName5)
+
+	s.Equal(&node{path: "/me"}, s.node.getLeaf("/user/me"))
+	s.Equal(&node{path: "/:id"}, s.node.getLeaf("/user/1"))
+	s.Equal(&node{path: "/settings"}, s.node.getLeaf("/user/me/settings"))
+	// parameter is matched if the rest of path doesn't match under static part
+	s.Equal(&node{path: "/orders"}, s.node.getLeaf("/user/me/orders"))
+	s.Equal(&node{path: "/*path"}, s.node.getLeaf("/user/1/photos"))
 }
 
 func (s *trieSuite) TestAddPath() {
@@ -209,6 +220,79 @@ func (s *trieSuite) TestAddPath() {
 	}, s.node)
 }
 
+func (s *trieSuite) TestAddPathRoutePart() {
+	var metricName, metricName2 string
+	// route is registered after longer route which its node is a part of
+	nameLeaf := s.node.addPath("/api/hello/:name", &metricName)
+	helloLeaf := s.node.addPath("/api/hello/", &metricName2)
+	helloLeaf.disabled = true
+
+	s.Equal("api_hello", metricName2)
+	s.Equal(&node{
+		children: []*node{
+			{
+				path: "/api/",
+				children: []*node{
+					{
+						path:     "/hello/",
+						children: []*node{nameLeaf},
+						disabled: true,
+					},
+				},
+			},
+		},
+	}, s.node)
+	s.Same(helloLeaf, s.node.getLeaf("/api/hello/"))
+}
+
+func (s *trieSuite) TestGetLeafRoutePart() {
+	var metricName, metricName2 string
+	s.node.addPath("/user/me/settings", &metricName).disabled = true
+	s.node.addPath("/user/:id/", &metricName2).disabled = true
+
+	// router matches parameter if static part is only a part of longer route
+	s.Equal(&node{path: "/:id/", disabled: true}, s.node.getLeaf("/user/me/"))
+}
+
+func (s *trieSuite) TestAddPathCatchAll() {
+	var metricName, metricName2 string
+	s.node.addPath("/static/*filepath", &metricName)
+	s.node.addPath("/api/:version/docs/*page", &metricName2)
+
+	s.Equal("static_filepath_all", metricName)
+	s.Equal("api_version_var_docs_page_all", metricName2)
+	s.Equal(&node{
+		children: []*node{
+			{
+				path: "/static/",
+				children: []*node{
+					{
+						path: "/*filepath",
+					},
+				},
+			},
+			{
+				path: "/api/",
+				children: []*node{
+					{
+						path: "/:version/",
+						children: []*node{
+							{
+								path: "/docs/",
+								children: []*node{
+									{
+										path: "/*page",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}, s.node)
+}
+
 func (s *trieSuite) TestAppendChild() {
 	metricName := "ping"
 	ch := s.node.appendChild(5, "/ping", "/ping", &metricName)
@@ -253,3 +337,282 @@ func (s *trieSuite) TestAppendChild() {
 		path: "/:name",
 	}, ch)
 }
+
+func (s *trieSuite) TestNormalizePath() {
+	for path, expected := range map[string]string{
+		"/ping":                   "/ping",
+		"/user/:id":               "/user/:id",
+		"/user/{id}/action-1":     "/user/:id/action-1",
+		"/user/{id:[0-9]+}":       "/user/:id",
+		"/user/{id:[0-9]{3}}/":    "/user/:id/",
+		"/file/{name}.{ext}":      "/file/:name_ext",
+		"/static/{filepath:*}":    "/static/*filepath",
+		"/user/{name?}":           "/user/:name",
+		"/api/{version}/{page:*}": "/api/:version/*page",
+	} {
+		s.Equal(expected, normalizePath(path), path)
+	}
+}
+
+func (s *trieSuite) TestOptionalPaths() {
+	s.Equal([]string{"/user/{id}"}, optionalPaths("/user/{id}"))
+	s.Equal([]string{"/user", "/user/{name}"}, optionalPaths("/user/{name?}"))
+	s.Equal([]string{"/a", "/a/{b}", "/a/{b}/{c}"}, optionalPaths("/a/{b?}/{c?}"))
+	s.Equal([]string{"/", "/{lang}"}, optionalPaths("/{lang?}"))
+	s.Equal([]string{"/a/{id:[0-9]?}"}, optionalPaths("/a/{id:[0-9]?}"))
+	s.Equal([]string{"/user", "/user/{name:[a-z]+}"}, optionalPaths("/user/{name?:[a-z]+}"))
+	s.Equal([]string{"/", "/{name:[a-zA-Z]{5}}"}, optionalPaths("/{name?:[a-zA-Z]{5}}"))
+}
+
+func (s *trieSuite) TestOptionalParamIndex() {
+	s.Equal(5, optionalParamIndex("{name?}"))
+	s.Equal(5, optionalParamIndex("{name?:[a-z]+}"))
+	s.Equal(-1, optionalParamIndex("{name}"))
+	s.Equal(-1, optionalParamIndex("{id:[0-9]?}"))
+	s.Equal(-1, optionalParamIndex("name?"))
+	s.Equal(-1, optionalParamIndex("{?}"))
+}
+
+func (s *trieSuite) TestGetLeafRoot() {
+	var metricName, metricName2 string
+	s.node.addPath("/", &metricName)
+	s.node.addPath("/:lang", &metricName2)
+
+	s.Equal("root", metricName)
+	s.Equal(&node{path: "/"}, s.node.getLeaf("/"))
+	s.Equal(&node{path: "/:lang"}, s.node.getLeaf("/en"))
+}
+
+func (s *trieSuite) TestClone() {
+	var metricName, metricName2 string
+	s.node.addPath("/user/:id", &metricName)
+	s.node.getLeaf("/user/1").histograms = map[string]prometheus.Histogram{
+		metricTypeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{Name: "duration"}),
+	}
+
+	cn := s.node.clone()
+	s.Equal(s.node, cn)
+
+	cn.addPath("/ping", &metricName2)
+	cn.getLeaf("/user/1").histograms[metricTypeRequestSize] = prometheus.NewHistogram(
+		prometheus.HistogramOpts{Name: "request_size"},
+	)
+
+	s.Nil(s.node.getLeaf("/ping"))
+	s.Len(s.node.getLeaf("/user/1").histograms, 1)
+	s.NotNil(cn.getLeaf("/ping"))
+	s.Len(cn.getLeaf("/user/1").histograms, 2)
+}
+
+func (s *trieSuite) TestRemovePath() {
+	var metricName, metricName2, metricName3 string
+	s.node.addPath("/api/hello/", &metricName).disabled = true
+	s.node.addPath("/api/hello/:name", &metricName2).disabled = true
+	s.node.addPath("/ping", &metricName3).disabled = true
+
+	s.Nil(s.node.removePath("/api/none"))
+	s.Nil(s.node.removePath("/api/"))
+
+	s.Equal(&node{
+		path: "/hello/",
+		children: []*node{
+			{
+				path:     "/:name",
+				disabled: true,
+			},
+		},
+		disabled: true,
+	}, s.node.removePath("/api/hello/"))
+	s.False(s.node.getLeaf("/api/hello/").isLeaf())
+
+	s.Equal(&node{path: "/:name", disabled: true}, s.node.removePath("/api/hello/:name"))
+	s.Nil(s.node.getLeaf("/api/hello/"))
+
+	s.Equal(&node{path: "/ping", disabled: true}, s.node.removePath("/ping"))
+	s.Empty(s.node.children)
+}
+
+// TestGetLeafMatchesRouter checks on random routes and paths that leaf found in the trie
+// belongs to the route which router dispatches request to
+func (s *trieSuite) TestGetLeafMatchesRouter() {
+	statics := []string{"user", "me", "orders", "a"}
+	for seed := int64(0); seed < 200; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		root := new(node)
+		r := fastrouter.New()
+		// redirects are not dispatches to routes
+		r.RedirectTrailingSlash = false
+		r.RedirectFixedPath = false
+		leaves := make(map[*node]string)
+		var routes []string
+
+		for i := 0; i < 8; i++ {
+			route := randomRoute(rnd, statics)
+			if !canRegisterRoute(append(routes, route)) || isAmbiguous(routes, route) {
+				continue
+			}
+			routes = append(routes, route)
+			for _, leaf := range s.registerRoute(r, root, route) {
+				leaves[leaf] = route
+			}
+		}
+
+		for i := 0; i < 20; i++ {
+			path := randomPath(rnd, statics)
+			ctx := newRequestCtx("GET", path)
+			r.Handler(ctx)
+
+			route := leaves[root.getLeaf(path)]
+			// router redirects path with toggled trailing slash of route and matches path of a part of longer routes
+			// depending on layout of its radix tree, e.g. /user/ of /user/{id} is not found or matches /{rest:*}
+			isPart, isRoute := matchRoutes(routes, path)
+			if _, tsr := r.Lookup("GET", path, nil); tsr || (isPart && !isRoute) {
+				continue
+			}
+			if ctx.Response.StatusCode() == fasthttp.StatusOK {
+				s.Equal(string(ctx.Response.Body()), route, "seed %d, path %s", seed, path)
+			} else {
+				s.Empty(route, "seed %d, path %s, status %d", seed, path, ctx.Response.StatusCode())
+			}
+		}
+	}
+}
+
+// canRegisterRoute reports if routes don't conflict in router,
+// route with optional parameter is registered partially by router if one of its paths conflicts
+func canRegisterRoute(routes []string) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+
+	r := fastrouter.New()
+	for _, route := range routes {
+		r.GET(route, func(ctx *fasthttp.RequestCtx) {})
+	}
+
+	return true
+}
+
+// isAmbiguous reports if route can't be distinguished from one of routes without regular expressions of parameters,
+// e.g. /{id} and /{id:[0-9]+}, or /{a}/b and /{c:[a-z]+}/{d} which router prioritizes by regular expression
+func isAmbiguous(routes []string, route string) bool {
+	params := make(map[string]bool)
+	for _, registered := range routes {
+		for prefix, regex := range paramPrefixes(registered) {
+			params[prefix] = regex
+		}
+	}
+	for prefix, regex := range paramPrefixes(route) {
+		if registeredRegex, ok := params[prefix]; ok && (regex || registeredRegex) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// paramPrefixes returns prefixes of route ending with parameter, parameters are replaced by ":",
+// and reports if parameter has regular expression
+func paramPrefixes(route string) map[string]bool {
+	paths := optionalPaths(route)
+	parts := strings.Split(paths[len(paths)-1], "/")
+	prefixes := make(map[string]bool)
+	for i, part := range parts {
+		if strings.HasPrefix(part, "{") && !strings.HasSuffix(part, ":*}") {
+			prefixes[strings.Join(parts[:i], "/")+"/:"] = strings.Contains(part, ":")
+			parts[i] = ":"
+		}
+	}
+
+	return prefixes
+}
+
+// matchRoutes reports if path with trailing slash is a part of one of routes, e.g. /user/ of /user/{id},
+// and if path is a path of one of routes without catch-all parameter, e.g. /user/1 of /user/{id}
+func matchRoutes(routes []string, path string) (isPart bool, isRoute bool) {
+	parts := strings.Split(path[1:], "/")
+	for _, route := range routes {
+		for _, routePath := range optionalPaths(route) {
+			routeParts := strings.Split(normalizePath(routePath)[1:], "/")
+			if len(routeParts) == len(parts) && matchParts(routeParts, parts) {
+				isRoute = true
+			}
+			if parts[len(parts)-1] == "" && len(routeParts) >= len(parts) && matchParts(routeParts, parts[:len(parts)-1]) {
+				isPart = true
+			}
+		}
+	}
+
+	return isPart, isRoute
+}
+
+// matchParts reports if parts match the first route parts, parameter matches any non-empty part
+func matchParts(routeParts []string, parts []string) bool {
+	for i, part := range parts {
+		if routeParts[i] != part && (!strings.HasPrefix(routeParts[i], ":") || part == "") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// registerRoute registers route in router and the trie like putMethod does, returns leaves of all paths of route
+func (s *trieSuite) registerRoute(r *fastrouter.Router, root *node, route string) []*node {
+	r.GET(route, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString(route)
+	})
+
+	var leaves []*node
+	for _, path := range optionalPaths(route) {
+		var metricName string
+		leaf := root.addPath(normalizePath(path), &metricName)
+		leaf.metrics = make(map[string]prometheus.Counter)
+		leaves = append(leaves, leaf)
+	}
+
+	return leaves
+}
+
+func randomRoute(rnd *rand.Rand, statics []string) string {
+	var route string
+	parts := rnd.Intn(3) + 1
+	for i := 0; i < parts; i++ {
+		switch n := rnd.Intn(10); {
+		case n < 6:
+			route += "/" + statics[rnd.Intn(len(statics))]
+		case n < 8:
+			route += "/{p" + strconv.Itoa(i) + "}"
+		case n < 9:
+			// regular expression matches any random path part
+			return route + "/{p" + strconv.Itoa(i) + "?:[a-z0-9]+}"
+		default:
+			return route + "/{rest:*}"
+		}
+	}
+	// route with trailing slash is a part of longer routes too, e.g. /user/ of /user/{p1}
+	if rnd.Intn(4) == 0 {
+		route += "/"
+	}
+
+	return route
+}
+
+func randomPath(rnd *rand.Rand, statics []string) string {
+	var path string
+	parts := rnd.Intn(4) + 1
+	for i := 0; i < parts; i++ {
+		if rnd.Intn(4) == 0 {
+			path += "/1"
+		} else {
+			path += "/" + statics[rnd.Intn(len(statics))]
+		}
+	}
+	if rnd.Intn(4) == 0 {
+		path += "/"
+	}
+
+	return path
+}